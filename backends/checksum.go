@@ -0,0 +1,45 @@
+package backends
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+const ChecksumKey = "checksum"
+const ChecksumS3Key = "X-Amz-Meta-Checksum"
+
+// ErrChecksumMismatch is returned when the copied data does not match the source
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// NewChecksum returns the hash for a checksum algorithm (md5, crc32c or sha256)
+func NewChecksum(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "md5":
+		return md5.New(), nil
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %s, use md5, crc32c or sha256", algo)
+}
+
+// FormatChecksum returns the checksum as stored in the object metadata, "<algo>:<hex>"
+func FormatChecksum(algo string, sum []byte) string {
+	return strings.ToLower(algo) + ":" + hex.EncodeToString(sum)
+}
+
+// ParseChecksum splits a stored checksum to the algorithm and hex digest
+func ParseChecksum(checksum string) (string, string) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
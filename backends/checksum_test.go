@@ -0,0 +1,30 @@
+package backends
+
+import (
+	"testing"
+)
+
+func TestNewChecksum(t *testing.T) {
+	tests := []struct {
+		algo     string
+		checksum string
+	}{
+		{"md5", "md5:9e107d9d372bb6826bd81d3542a419d6"},
+		{"CRC32C", "crc32c:22620404"},
+		{"sha256", "sha256:d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"},
+	}
+	for _, test := range tests {
+		sum, err := NewChecksum(test.algo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.algo, err)
+		}
+		sum.Write([]byte("The quick brown fox jumps over the lazy dog"))
+		if checksum := FormatChecksum(test.algo, sum.Sum(nil)); checksum != test.checksum {
+			t.Errorf("%s: expected %s got %s", test.algo, test.checksum, checksum)
+		}
+	}
+
+	if _, err := NewChecksum("sha1"); err == nil {
+		t.Errorf("expected an error for an unsupported algorithm")
+	}
+}
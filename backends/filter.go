@@ -0,0 +1,211 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter is an ordered list of include and exclude patterns matched against the
+// path relative to the listed directory, the last matching pattern decides (like
+// gitignore). Paths which match no pattern are included, unless Include patterns
+// were added. A file is excluded if one of its parent directories is.
+//
+// Patterns without a slash match the name at any depth, other patterns match
+// from the listed directory. "*" and "?" do not match "/", "**" matches any
+// number of directories and a trailing "/" only matches directories.
+type Filter struct {
+	rules       []*filterRule
+	hasIncludes bool
+}
+
+type filterRule struct {
+	pattern string
+	include bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Include adds a pattern of files to include
+func (f *Filter) Include(pattern string) error {
+	f.hasIncludes = true
+	return f.add(pattern, true)
+}
+
+// Exclude adds a pattern of files to exclude
+func (f *Filter) Exclude(pattern string) error {
+	return f.add(pattern, false)
+}
+
+// reinclude adds a pattern of files to include again after an exclude pattern,
+// unlike Include the files which match no pattern are still included
+func (f *Filter) reinclude(pattern string) error {
+	return f.add(pattern, true)
+}
+
+// ExcludeFrom adds the exclude patterns of a file, one per line, empty lines and
+// lines starting with "#" are ignored and patterns starting with "!" are included
+// again (like gitignore)
+func (f *Filter) ExcludeFrom(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			err = f.reinclude(line[1:])
+		} else {
+			err = f.Exclude(line)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (f *Filter) add(pattern string, include bool) error {
+	rule := filterRule{pattern: pattern, include: include}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return fmt.Errorf("empty filter pattern %q", rule.pattern)
+	}
+
+	expr, err := globToRegexp(pattern)
+	if err != nil {
+		return fmt.Errorf("bad filter pattern %q, %v", rule.pattern, err)
+	}
+	if rule.re, err = regexp.Compile(expr); err != nil {
+		return fmt.Errorf("bad filter pattern %q, %v", rule.pattern, err)
+	}
+	f.rules = append(f.rules, &rule)
+	return nil
+}
+
+// Match returns true if a file (relative path) is included
+func (f *Filter) Match(relPath string) bool {
+	if f == nil || len(f.rules) == 0 {
+		return true
+	}
+	relPath = strings.Trim(relPath, "/")
+	if dir := path.Dir(relPath); dir != "." && !f.MatchDir(dir) {
+		return false
+	}
+	included, matched := f.decide(relPath, false)
+	return included || (!matched && !f.hasIncludes)
+}
+
+// MatchDir returns false if a directory (relative path) or one of its parents
+// is excluded, excluded directories are not listed
+func (f *Filter) MatchDir(relDir string) bool {
+	if f == nil || len(f.rules) == 0 {
+		return true
+	}
+	relDir = strings.Trim(relDir, "/")
+	if relDir == "" {
+		return true
+	}
+	parts := strings.Split(relDir, "/")
+	for i := range parts {
+		if f.excluded(strings.Join(parts[:i+1], "/")) {
+			return false
+		}
+	}
+	return true
+}
+
+// excluded returns true if the last pattern matching a directory excludes it,
+// include patterns do not exclude the directories which do not match
+func (f *Filter) excluded(relDir string) bool {
+	included, matched := f.decide(relDir, true)
+	return matched && !included
+}
+
+func (f *Filter) decide(relPath string, isDir bool) (included, matched bool) {
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		rule := f.rules[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			return rule.include, true
+		}
+	}
+	return false, false
+}
+
+// globToRegexp converts a pattern to a regular expression of the relative path
+func globToRegexp(pattern string) (string, error) {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("missing ]")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String(), nil
+}
+
+// relativeKey returns a listed key relative to the listed directory
+func relativeKey(dir, key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, dir), "/")
+}
+
+// relativeFileKey returns a listed file key relative to the listed directory,
+// or the file name when the listed path is the file itself
+func relativeFileKey(dir, key string) string {
+	if relPath := relativeKey(dir, key); relPath != "" {
+		return relPath
+	}
+	return path.Base(key)
+}
@@ -0,0 +1,90 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	type rule struct {
+		pattern string
+		include bool
+	}
+	tests := []struct {
+		rules   []rule
+		path    string
+		isDir   bool
+		matched bool
+	}{
+		{[]rule{{"*.tmp", false}}, "a.tmp", false, false},
+		{[]rule{{"*.tmp", false}}, "dir/sub/a.tmp", false, false},
+		{[]rule{{"*.tmp", false}}, "a.csv", false, true},
+		// last match wins
+		{[]rule{{"*.tmp", false}, {"keep.tmp", true}}, "dir/keep.tmp", false, true},
+		{[]rule{{"keep.tmp", true}, {"*.tmp", false}}, "dir/keep.tmp", false, false},
+		// only the included files with include patterns
+		{[]rule{{"*.csv", true}}, "dir/a.csv", false, true},
+		{[]rule{{"*.csv", true}}, "dir/a.txt", false, false},
+		{[]rule{{"*.csv", true}}, "dir", true, true},
+		// patterns with a slash are relative to the listed dir
+		{[]rule{{"logs/*.log", false}}, "logs/a.log", false, false},
+		{[]rule{{"logs/*.log", false}}, "app/logs/a.log", false, true},
+		{[]rule{{"logs/*.log", false}}, "logs/old/a.log", false, true},
+		{[]rule{{"/a.csv", false}}, "dir/a.csv", false, true},
+		{[]rule{{"**/logs/*.log", false}}, "app/logs/a.log", false, false},
+		{[]rule{{"logs/**", false}}, "logs/old/a.log", false, false},
+		{[]rule{{"data/**/*.csv", true}}, "data/a.csv", false, true},
+		{[]rule{{"data/**/*.csv", true}}, "data/2020/01/a.csv", false, true},
+		{[]rule{{"data/**/*.csv", true}}, "other/a.csv", false, false},
+		// directories exclude everything below them
+		{[]rule{{"tmp/", false}}, "tmp", true, false},
+		{[]rule{{"tmp/", false}}, "a/tmp/b/c.csv", false, false},
+		{[]rule{{"tmp/", false}}, "a/tmp", false, true},
+		{[]rule{{"tmp", false}, {"*.csv", true}}, "tmp/a.csv", false, false},
+		{[]rule{{"[!a]?.csv", false}}, "bc.csv", false, false},
+		{[]rule{{"[!a]?.csv", false}}, "ac.csv", false, true},
+	}
+
+	for _, test := range tests {
+		filter := NewFilter()
+		for _, r := range test.rules {
+			var err error
+			if r.include {
+				err = filter.Include(r.pattern)
+			} else {
+				err = filter.Exclude(r.pattern)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		matched := filter.Match(test.path)
+		if test.isDir {
+			matched = filter.MatchDir(test.path)
+		}
+		if matched != test.matched {
+			t.Errorf("%v %s: expected %v got %v", test.rules, test.path, test.matched, matched)
+		}
+	}
+}
+
+func TestFilterExcludeFrom(t *testing.T) {
+	f, err := ioutil.TempFile("", "xcp-exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# build output\n*.o\n\n!main.o\nbuild/\n")
+	f.Close()
+
+	filter := NewFilter()
+	if err := filter.ExcludeFrom(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]bool{"a.o": false, "src/main.o": true, "build/x.c": false, "a.c": true} {
+		if filter.Match(path) != expected {
+			t.Errorf("%s: expected %v", path, expected)
+		}
+	}
+}
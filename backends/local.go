@@ -1,14 +1,21 @@
 package backends
 
 import (
+	"context"
 	"github.com/nuclio/logger"
+	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
+// LocalInPlaceWrites writes local files directly to the target path, by default
+// files are written to a temp file which is renamed to the target path on Close
+var LocalInPlaceWrites = false
+
 type LocalClient struct {
 	logger logger.Logger
 	params *PathParams
@@ -23,10 +30,13 @@ func NewLocalClient(logger logger.Logger, params *PathParams) (FSClient, error)
 	return &LocalClient{logger: logger, params: params}, err
 }
 
-func (c *LocalClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+func (c *LocalClient) ListDir(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
 	defer close(fileChan)
 
 	visit := func(localPath string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			c.logger.Error("List walk error with path %s, %v", localPath, err)
 			return err
@@ -35,7 +45,8 @@ func (c *LocalClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, sum
 
 		if fi.IsDir() {
 			relPath := strings.TrimPrefix(localPath, filepath.ToSlash(c.params.Path))
-			if (relPath != "" && !task.Recursive) || (!task.Hidden && strings.HasPrefix(fi.Name(), ".")) {
+			if (relPath != "" && !task.IsRecursive()) || (!task.Hidden && strings.HasPrefix(fi.Name(), ".")) ||
+				!task.matchDir(relPath) {
 				return filepath.SkipDir
 			}
 			return nil
@@ -45,7 +56,7 @@ func (c *LocalClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, sum
 			return nil
 		}
 
-		if !IsMatch(task, fi.Name(), fi.ModTime(), fi.Size()) {
+		if !IsMatch(task, relativeFileKey(filepath.ToSlash(c.params.Path), localPath), fi.ModTime(), fi.Size()) {
 			return nil
 		}
 
@@ -57,7 +68,11 @@ func (c *LocalClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, sum
 
 		summary.TotalBytes += fi.Size()
 		summary.TotalFiles += 1
-		fileChan <- fileDetails
+		select {
+		case fileChan <- fileDetails:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
 		return nil
 	}
@@ -65,7 +80,7 @@ func (c *LocalClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, sum
 	return filepath.Walk(c.params.Path, visit)
 }
 
-func (c *LocalClient) Reader(path string) (FSReader, error) {
+func (c *LocalClient) Reader(ctx context.Context, path string) (FSReader, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -81,6 +96,10 @@ func (r *fileReader) Read(p []byte) (n int, err error) {
 	return r.f.Read(p)
 }
 
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	return r.f.Seek(offset, whence)
+}
+
 func (r *fileReader) Close() error {
 	return r.f.Close()
 }
@@ -94,33 +113,90 @@ func (r *fileReader) Stat() (*FileMeta, error) {
 	return &meta, err
 }
 
-func (c *LocalClient) Writer(path string, opts *FileMeta) (io.WriteCloser, error) {
+func (c *LocalClient) Stat(ctx context.Context, path string) (*FileDetails, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrNotFound, path)
+	} else if err != nil {
+		return nil, err
+	}
+	return &FileDetails{Key: path, Size: fi.Size(), Mtime: fi.ModTime(), Mode: uint32(fi.Mode())}, nil
+}
+
+func (c *LocalClient) Delete(ctx context.Context, path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	return err
+}
+
+func (c *LocalClient) Mkdir(ctx context.Context, path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (c *LocalClient) Rename(ctx context.Context, oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(oldPath, newPath)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, oldPath)
+	}
+	return err
+}
+
+func (c *LocalClient) Writer(ctx context.Context, path string, opts *FileMeta) (io.WriteCloser, error) {
 	if err := ValidFSTarget(path); err != nil {
 		return nil, err
 	}
 
-	mode := uint32(0666)
-	if opts != nil && opts.Mode > 0 {
-		mode = opts.Mode
+	writer := fileWriter{path: path}
+	if opts != nil {
+		writer.mtime = opts.Mtime
 	}
 
-	f, err := os.OpenFile(
-		path,
-		os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
-		os.FileMode(mode),
-	)
+	if LocalInPlaceWrites {
+		mode := uint32(0666)
+		if opts != nil && opts.Mode > 0 {
+			mode = opts.Mode
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		writer.f = f
+		return &writer, nil
+	}
 
-	if err != nil || opts == nil || opts.Mtime.IsZero() {
-		return f, err
+	// the temp file gets the source mode, or the mode of the file it replaces
+	mode := os.FileMode(0644)
+	if opts != nil && opts.Mode > 0 {
+		mode = os.FileMode(opts.Mode).Perm()
+	} else if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
 	}
 
-	return &fileWriter{f: f, mtime: opts.Mtime, path: path}, nil
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name+".xcp-tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	writer.f, writer.tmpPath = f, f.Name()
+	if err := f.Chmod(mode); err != nil {
+		writer.Abort()
+		return nil, err
+	}
+	return &writer, nil
 }
 
+// fileWriter writes to a hidden temp file in the target dir which is renamed
+// to the target path on Close, or directly to the target with LocalInPlaceWrites
 type fileWriter struct {
-	f     *os.File
-	mtime time.Time
-	path  string
+	f       *os.File
+	mtime   time.Time
+	path    string
+	tmpPath string
 }
 
 func (w *fileWriter) Write(p []byte) (n int, err error) {
@@ -128,12 +204,46 @@ func (w *fileWriter) Write(p []byte) (n int, err error) {
 }
 
 func (w *fileWriter) Close() error {
-	err := w.f.Close()
-	if err != nil {
+	if w.tmpPath == "" {
+		err := w.f.Close()
+		if err != nil {
+			return err
+		}
+		if w.mtime.IsZero() {
+			return nil
+		}
+		return os.Chtimes(w.path, w.mtime, w.mtime)
+	}
+
+	if err := w.commit(); err != nil {
+		os.Remove(w.tmpPath)
 		return err
 	}
-	if w.mtime.IsZero() {
-		return nil
+	return nil
+}
+
+// commit syncs the temp file to disk and renames it to the target path
+func (w *fileWriter) commit() error {
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if !w.mtime.IsZero() {
+		if err := os.Chtimes(w.tmpPath, w.mtime, w.mtime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(w.tmpPath, w.path)
+}
+
+// Abort closes and removes the partially written (temp) file
+func (w *fileWriter) Abort() error {
+	w.f.Close()
+	if w.tmpPath != "" {
+		return os.Remove(w.tmpPath)
 	}
-	return os.Chtimes(w.path, w.mtime, w.mtime)
+	return os.Remove(w.path)
 }
@@ -3,6 +3,7 @@ package backends
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestFileParser(t *testing.T) {
@@ -16,3 +17,52 @@ func TestFileParser(t *testing.T) {
 		fmt.Println(p, err)
 	}
 }
+
+func TestPathPattern(t *testing.T) {
+	p := PathParams{}
+	if err := ParseFilename("bucket/logs/2024-*/**/*.json", &p, true); err != nil {
+		t.Fatal(err)
+	}
+	if p.Path != "bucket/logs/" || p.filter != "2024-*/**/*.json" {
+		t.Fatalf("expected listing from bucket/logs/ with filter 2024-*/**/*.json, got %s %s", p.Path, p.filter)
+	}
+
+	task := ListDirTask{Source: &p}
+	if !task.IsRecursive() {
+		t.Error("expected a recursive listing with a path pattern")
+	}
+	for relPath, expected := range map[string]bool{
+		"2024-01/a.json": true, "2024-01/02/03/a.json": true, "2023-01/a.json": false,
+		"2024-01/a.csv": false, "a.json": false,
+	} {
+		if IsMatch(&task, relPath, time.Time{}, 1) != expected {
+			t.Errorf("%s: expected match %v", relPath, expected)
+		}
+	}
+	for relDir, expected := range map[string]bool{"2024-01": true, "2024-01/02/03": true, "2023-01": false} {
+		if task.matchDir(relDir) != expected {
+			t.Errorf("%s: expected dir match %v", relDir, expected)
+		}
+	}
+
+	p = PathParams{}
+	if err := ParseFilename("*/part-*.parquet", &p, true); err != nil {
+		t.Fatal(err)
+	}
+	task = ListDirTask{Source: &p}
+	if p.Path != "" || !IsMatch(&task, "data/part-1.parquet", time.Time{}, 1) ||
+		IsMatch(&task, "data/x/part-1.parquet", time.Time{}, 1) || task.matchDir("data/x") {
+		t.Errorf("unexpected match of */part-*.parquet with path %q", p.Path)
+	}
+
+	// a trailing ** matches the files at any depth
+	p = PathParams{}
+	if err := ParseFilename("src/logs/**", &p, true); err != nil {
+		t.Fatal(err)
+	}
+	task = ListDirTask{Source: &p}
+	if p.Path != "src/logs/" || !task.IsRecursive() || !task.matchDir("a/b") ||
+		!IsMatch(&task, "top.json", time.Time{}, 1) || !IsMatch(&task, "a/b/deep.json", time.Time{}, 1) {
+		t.Errorf("unexpected match of src/logs/** with path %q", p.Path)
+	}
+}
@@ -0,0 +1,87 @@
+package backends
+
+import (
+	"fmt"
+	"github.com/nuclio/logger"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ClientConstructor creates a backend client for the parsed path params
+type ClientConstructor func(logger logger.Logger, params *PathParams) (FSClient, error)
+
+// URLParser completes the path params parsed from a URL with the scheme, the
+// generic fields (Kind, Path, Tag, credentials) are already set, the URL host
+// is used as the endpoint if the parser is nil
+type URLParser func(u *url.URL, params *PathParams) error
+
+type backend struct {
+	newClient ClientConstructor
+	parseURL  URLParser
+}
+
+var registry = struct {
+	sync.RWMutex
+	backends map[string]backend
+}{backends: map[string]backend{}}
+
+func init() {
+	RegisterBackend("file", NewLocalClient, nil)
+	RegisterBackend("s3", NewS3Client, parseS3URL)
+	RegisterBackend("http", NewS3Client, parseHTTPURL)
+	RegisterBackend("https", NewS3Client, parseHTTPURL)
+	RegisterBackend("v3io", NewV3ioClient, parseV3ioURL)
+	RegisterBackend("v3ios", NewV3ioClient, parseV3ioURL)
+	RegisterBackend("sftp", NewSftpClient, parseSftpURL)
+	RegisterBackend("scp", NewSftpClient, parseSftpURL)
+}
+
+// RegisterBackend adds (or replaces) the backend of a URL scheme, the parser
+// may change params.Kind to the scheme of another registered backend
+func RegisterBackend(scheme string, newClient ClientConstructor, parseURL URLParser) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.backends[strings.ToLower(scheme)] = backend{newClient: newClient, parseURL: parseURL}
+}
+
+// Schemes returns the registered URL schemes, sorted
+func Schemes() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	schemes := make([]string, 0, len(registry.backends))
+	for scheme := range registry.backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// ParseURL completes the params with the parser of the URL scheme
+func ParseURL(u *url.URL, params *PathParams) error {
+	registry.RLock()
+	b, ok := registry.backends[params.Kind]
+	registry.RUnlock()
+	if !ok || b.parseURL == nil {
+		params.Endpoint = u.Host
+		return nil
+	}
+	return b.parseURL(u, params)
+}
+
+// GetNewClient creates a client with the backend registered for params.Kind,
+// an empty kind is a local path
+func GetNewClient(logger logger.Logger, params *PathParams) (FSClient, error) {
+	kind := strings.ToLower(params.Kind)
+	if kind == "" {
+		kind = "file"
+	}
+	registry.RLock()
+	b, ok := registry.backends[kind]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend %s use one of: %s", params.Kind, strings.Join(Schemes(), ", "))
+	}
+	return b.newClient(logger, params)
+}
@@ -0,0 +1,74 @@
+package backends
+
+import (
+	"github.com/nuclio/logger"
+	"net/url"
+	"testing"
+)
+
+type testClient struct {
+	FSClient
+	params *PathParams
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("test", func(_ logger.Logger, params *PathParams) (FSClient, error) {
+		return &testClient{params: params}, nil
+	}, func(u *url.URL, params *PathParams) error {
+		params.Bucket = u.Host
+		return nil
+	})
+	defer func() {
+		registry.Lock()
+		delete(registry.backends, "test")
+		registry.Unlock()
+	}()
+
+	found := false
+	for _, scheme := range Schemes() {
+		found = found || scheme == "test"
+	}
+	if !found {
+		t.Fatalf("test scheme is not listed in %v", Schemes())
+	}
+
+	u, _ := url.Parse("test://mybucket/dir")
+	params := PathParams{Kind: "test"}
+	if err := ParseURL(u, &params); err != nil || params.Bucket != "mybucket" || params.Endpoint != "" {
+		t.Fatalf("unexpected params %+v (%v)", params, err)
+	}
+	client, err := GetNewClient(nil, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.(*testClient).params != &params {
+		t.Fatalf("the client was not created with the params")
+	}
+
+	if _, err := GetNewClient(nil, &PathParams{Kind: "unknown"}); err == nil {
+		t.Fatalf("expected an error for an unknown backend")
+	}
+}
+
+func TestParseBuiltinURLs(t *testing.T) {
+	tests := []struct {
+		url    string
+		expect PathParams
+	}{
+		{"v3ios://webapi:8081/users/dir", PathParams{Kind: "v3io", Endpoint: "webapi:8081", Bucket: "users", Path: "dir", Secure: true}},
+		{"https://minio:9000/bucket/dir", PathParams{Kind: "s3", Endpoint: "minio:9000", Bucket: "bucket", Path: "dir", Secure: true}},
+		{"scp://host:2222/~/dir", PathParams{Kind: "scp", Endpoint: "host:2222", Path: "dir"}},
+		{"other://host/dir", PathParams{Kind: "other", Endpoint: "host", Path: "dir"}},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		// the generic fields as set by the url parser
+		params := PathParams{Kind: u.Scheme, Path: u.Path[1:]}
+		if err := ParseURL(u, &params); err != nil {
+			t.Fatal(err)
+		}
+		if params != test.expect {
+			t.Fatalf("%s: expected %+v got %+v", test.url, test.expect, params)
+		}
+	}
+}
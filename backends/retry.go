@@ -0,0 +1,105 @@
+package backends
+
+import (
+	"context"
+	"github.com/minio/minio-go"
+	"github.com/nuclio/logger"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	v3ioerrors "github.com/v3io/v3io-go/pkg/errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	// max number of attempts per operation (1 disables retries)
+	MaxAttempts int
+	// delay before the first retry, doubled on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// random +/- fraction added to every delay
+	Jitter float64
+
+	retries int64
+}
+
+// Retry is the policy used by the backends and operators for transient failures
+var Retry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second, Jitter: 0.2}
+
+var retryableS3Codes = map[string]bool{
+	"RequestError": true, "RequestTimeout": true, "Throttling": true, "ThrottlingException": true,
+	"RequestLimitExceeded": true, "RequestThrottled": true, "InternalError": true, "SlowDown": true,
+	"ServiceUnavailable": true,
+}
+
+// Do runs op until it succeeds, fails with a permanent error, the max attempts
+// are reached, or the context is done, the last error is returned
+func (p *RetryPolicy) Do(ctx context.Context, logger logger.Logger, op func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || attempt >= p.MaxAttempts || !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := p.delay(attempt)
+		atomic.AddInt64(&p.retries, 1)
+		logger.WarnWith("retrying after error", "attempt", attempt, "delay", delay.String(), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.Backoff << uint(attempt-1)
+	if delay <= 0 || (p.MaxBackoff > 0 && delay > p.MaxBackoff) {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// Retries returns the total number of retries done with this policy
+func (p *RetryPolicy) Retries() int64 {
+	return atomic.LoadInt64(&p.retries)
+}
+
+// IsRetryable returns true for transient errors (5xx, throttling, timeouts,
+// connection resets, corrupted copies), and false for permanent ones (e.g. 403, 404)
+func IsRetryable(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case nil:
+		return false
+	case minio.ErrorResponse:
+		return retryableS3Codes[e.Code] || isRetryableStatus(e.StatusCode)
+	case v3ioerrors.ErrorWithStatusCode:
+		return isRetryableStatus(e.StatusCode())
+	case *url.Error:
+		return IsRetryable(e.Err)
+	case *net.OpError:
+		return true
+	case *os.SyscallError:
+		return IsRetryable(e.Err)
+	case net.Error:
+		return e.Timeout()
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNABORTED || e == syscall.EPIPE || e == syscall.ETIMEDOUT
+	default:
+		return e == io.ErrUnexpectedEOF || e == ErrChecksumMismatch || e == sftp.ErrSSHFxConnectionLost || e == v3ioerrors.ErrTimeout
+	}
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == 429
+}
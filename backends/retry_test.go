@@ -0,0 +1,89 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go"
+	"github.com/nuclio/zap"
+	"github.com/pkg/errors"
+	v3ioerrors "github.com/v3io/v3io-go/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, true},
+		{minio.ErrorResponse{Code: "InternalError", StatusCode: 500}, true},
+		{minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, false},
+		{minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, false},
+		{v3ioerrors.NewErrorWithStatusCode(fmt.Errorf("busy"), 503), true},
+		{v3ioerrors.NewErrorWithStatusCode(fmt.Errorf("not found"), 404), false},
+		{errors.Wrap(v3ioerrors.NewErrorWithStatusCode(fmt.Errorf("busy"), 429), "wrapped"), true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{errors.Wrap(io.ErrUnexpectedEOF, "wrapped"), true},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT}, false},
+		{fmt.Errorf("some error"), false},
+	}
+
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("IsRetryable(%v) expected %v", test.err, test.retryable)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	logger, _ := nucliozap.NewNuclioZapCmd("test", nucliozap.ErrorLevel)
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), logger, func() error {
+		attempts++
+		return minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}
+	})
+	if err == nil || attempts != 3 || policy.Retries() != 2 {
+		t.Fatalf("expected 3 failed attempts, got %d attempts, %d retries, err %v", attempts, policy.Retries(), err)
+	}
+
+	attempts = 0
+	err = policy.Do(context.Background(), logger, func() error {
+		attempts++
+		return minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected a single attempt for a permanent error, got %d", attempts)
+	}
+
+	attempts = 0
+	err = policy.Do(context.Background(), logger, func() error {
+		attempts++
+		if attempts < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected success on the second attempt, got %d attempts, err %v", attempts, err)
+	}
+
+	// a canceled context stops the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = policy.Do(ctx, logger, func() error {
+		attempts++
+		cancel()
+		return io.ErrUnexpectedEOF
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected a single attempt after cancel, got %d", attempts)
+	}
+}
@@ -3,17 +3,44 @@ package backends
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"github.com/minio/minio-go"
 	"github.com/minio/minio-go/pkg/s3utils"
 	"github.com/nuclio/logger"
 	"github.com/pkg/errors"
 	"io"
-	"path/filepath"
+	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// S3PartSize is the multipart upload part size used by the s3 writer, objects
+// smaller than a single part are uploaded with one PutObject call
+var S3PartSize int64 = 16 * 1024 * 1024
+
+// S3MaxParts is the max number of parts of a multipart upload (the s3 limit),
+// the part size is raised for files which are larger than S3MaxParts parts
+var S3MaxParts = 10000
+
+// S3MaxCopySize is the largest object copied server side with a single
+// CopyObject request (the s3 limit), larger objects are copied in parts
+var S3MaxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// S3CopyPartSize is the part size of server side multipart copies, raised for
+// objects which are larger than S3MaxParts parts
+var S3CopyPartSize int64 = 512 * 1024 * 1024
+
+// S3MaxInflightParts limits the number of parts uploaded concurrently by each writer
+var S3MaxInflightParts = 4
+
+// S3StatWorkers is the number of concurrent HEAD requests used to read the
+// original mtime and mode of the listed objects (with ListDirTask.WithMeta)
+var S3StatWorkers = 16
+
 type s3client struct {
 	params      *PathParams
 	logger      logger.Logger
@@ -47,6 +74,22 @@ func NewS3Client(logger logger.Logger, params *PathParams) (FSClient, error) {
 	return &newClient, nil
 }
 
+// parseS3URL parses s3://<bucket>/path URLs
+func parseS3URL(u *url.URL, params *PathParams) error {
+	// TODO: region url
+	params.Bucket = u.Host
+	return nil
+}
+
+// parseHTTPURL parses http(s)://<endpoint>/<bucket>/path URLs of S3 compatible services
+func parseHTTPURL(u *url.URL, params *PathParams) error {
+	params.Secure = params.Kind == "https"
+	params.Kind = "s3"
+	params.Endpoint = u.Host
+	params.Bucket, params.Path = SplitPath(params.Path)
+	return nil
+}
+
 func SplitPath(path string) (string, string) {
 	if strings.HasPrefix(path, "/") {
 		path = path[1:]
@@ -58,13 +101,21 @@ func SplitPath(path string) (string, string) {
 	return parts[0], path[len(parts[0])+1:]
 }
 
-func (c *s3client) ListDir(fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+func (c *s3client) ListDir(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+	if task.WithMeta {
+		defer close(fileChan)
+		return c.listWithMeta(ctx, fileChan, task, summary)
+	}
+
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 	defer close(fileChan)
 
-	objCh := c.minioClient.ListObjectsV2(c.params.Bucket, c.params.Path, task.Recursive, doneCh)
+	objCh := c.minioClient.ListObjectsV2(c.params.Bucket, c.params.Path, task.IsRecursive(), doneCh)
 	for obj := range objCh {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if obj.Err != nil {
 			return errors.WithStack(obj.Err)
 		}
@@ -73,8 +124,7 @@ func (c *s3client) ListDir(fileChan chan *FileDetails, task *ListDirTask, summar
 			continue
 		}
 
-		_, name := filepath.Split(obj.Key)
-		if !IsMatch(task, name, obj.LastModified, obj.Size) {
+		if !IsMatch(task, relativeFileKey(c.params.Path, obj.Key), obj.LastModified, obj.Size) {
 			continue
 		}
 
@@ -86,19 +136,112 @@ func (c *s3client) ListDir(fileChan chan *FileDetails, task *ListDirTask, summar
 
 		summary.TotalBytes += obj.Size
 		summary.TotalFiles += 1
-		fileChan <- fileDetails
+		select {
+		case fileChan <- fileDetails:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
+// listWithMeta lists the objects with the original mtime and mode stored in
+// their user metadata, the time filter is applied to the original mtime
+func (c *s3client) listWithMeta(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var lock sync.Mutex
+	var listErr error
+	fail := func(err error) {
+		lock.Lock()
+		if listErr == nil {
+			listErr = err
+		}
+		lock.Unlock()
+		cancel()
+	}
+
+	objCh := make(chan minio.ObjectInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < S3StatWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range objCh {
+				if ctx.Err() != nil {
+					continue
+				}
+				var fileDetails *FileDetails
+				err := Retry.Do(ctx, c.logger, func() error {
+					var err error
+					fileDetails, err = c.Stat(ctx, c.params.Bucket+"/"+obj.Key)
+					return err
+				})
+				if IsNotFound(err) {
+					// deleted since it was listed
+					c.logger.DebugWith("listed object not found", "key", obj.Key)
+					continue
+				} else if err != nil {
+					fail(errors.Wrapf(err, "failed to stat %s", obj.Key))
+					continue
+				}
+				if !IsMatch(task, relativeFileKey(c.params.Path, obj.Key), fileDetails.Mtime, fileDetails.Size) {
+					continue
+				}
+
+				c.logger.DebugWith("List dir:", "key", obj.Key,
+					"modified", fileDetails.Mtime, "size", fileDetails.Size, "mode", fileDetails.Mode)
+				lock.Lock()
+				summary.TotalBytes += fileDetails.Size
+				summary.TotalFiles += 1
+				lock.Unlock()
+				select {
+				case fileChan <- fileDetails:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	// the other filters are checked before the HEAD requests
+	untimed := *task
+	untimed.Since, untimed.Until = time.Time{}, time.Time{}
+	objects := c.minioClient.ListObjectsV2(c.params.Bucket, c.params.Path, task.IsRecursive(), doneCh)
+list:
+	for obj := range objects {
+		if obj.Err != nil {
+			fail(errors.WithStack(obj.Err))
+			break
+		}
+		if strings.HasSuffix(obj.Key, "/") || !IsMatch(&untimed, relativeFileKey(c.params.Path, obj.Key), obj.LastModified, obj.Size) {
+			continue
+		}
+		select {
+		case objCh <- obj:
+		case <-ctx.Done():
+			break list
+		}
+	}
+	close(objCh)
+	wg.Wait()
+
+	if listErr != nil {
+		return listErr
+	}
+	return ctx.Err()
+}
+
 func (c *s3client) PutObject(objectPath, filePath string) (n int64, err error) {
 	bucket, objectName := SplitPath(objectPath)
 	return c.minioClient.FPutObjectWithContext(
 		context.Background(), bucket, objectName, filePath, minio.PutObjectOptions{})
 }
 
-func (c *s3client) Reader(path string) (FSReader, error) {
+func (c *s3client) Reader(ctx context.Context, path string) (FSReader, error) {
 	bucket, objectName := SplitPath(path)
 	if err := s3utils.CheckValidBucketName(bucket); err != nil {
 		return nil, err
@@ -107,7 +250,7 @@ func (c *s3client) Reader(path string) (FSReader, error) {
 		return nil, err
 	}
 
-	obj, err := c.minioClient.GetObject(bucket, objectName, minio.GetObjectOptions{})
+	obj, err := c.minioClient.GetObjectWithContext(ctx, bucket, objectName, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +265,10 @@ func (r *s3Reader) Read(p []byte) (n int, err error) {
 	return r.obj.Read(p)
 }
 
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	return r.obj.Seek(offset, whence)
+}
+
 func (r *s3Reader) Close() error {
 	return r.obj.Close()
 }
@@ -131,6 +278,12 @@ func (r *s3Reader) Stat() (*FileMeta, error) {
 	if err != nil {
 		return nil, err
 	}
+	return s3FileMeta(stat), nil
+}
+
+// s3FileMeta returns the original mtime and mode from the object user metadata,
+// or the object time if the mtime was not stored
+func s3FileMeta(stat minio.ObjectInfo) *FileMeta {
 	var mode uint32
 	if stat.Metadata.Get(OriginalModeS3Key) != "" {
 		if i, err := strconv.Atoi(stat.Metadata.Get(OriginalModeS3Key)); err == nil {
@@ -140,48 +293,445 @@ func (r *s3Reader) Stat() (*FileMeta, error) {
 
 	modified := stat.LastModified
 	if stat.Metadata.Get(OriginalMtimeS3Key) != "" {
-		if t, err := time.Parse(time.RFC3339, stat.Metadata.Get(OriginalMtimeS3Key)); err == nil {
+		if t, err := time.Parse(time.RFC3339, stat.Metadata.Get(OriginalMtimeS3Key)); err == nil && !t.IsZero() {
 			modified = t
 		}
 	}
 
-	meta := FileMeta{Mtime: modified, Mode: uint32(mode)}
-	return &meta, err
+	return &FileMeta{Mtime: modified, Mode: mode, Checksum: stat.Metadata.Get(ChecksumS3Key)}
 }
 
-func (c *s3client) Writer(path string, opts *FileMeta) (io.WriteCloser, error) {
-	return &s3Writer{bucket: c.params.Bucket, path: path, client: c, opts: opts}, nil
+// Stat returns the object size and the original mtime and mode (if stored)
+func (c *s3client) Stat(ctx context.Context, path string) (*FileDetails, error) {
+	bucket, objectName := SplitPath(path)
+	stat, err := c.minioClient.StatObject(bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, errors.Wrap(ErrNotFound, path)
+		}
+		return nil, err
+	}
+	meta := s3FileMeta(stat)
+	return &FileDetails{Key: path, Size: stat.Size, Mtime: meta.Mtime, Mode: meta.Mode, Checksum: meta.Checksum}, nil
 }
 
-type s3Writer struct {
-	bucket string
-	path   string
-	buf    []byte
-	opts   *FileMeta
-	client *s3client
+func (c *s3client) Delete(ctx context.Context, path string) error {
+	bucket, objectName := SplitPath(path)
+	return c.minioClient.RemoveObject(bucket, objectName)
 }
 
-func (w *s3Writer) Write(p []byte) (n int, err error) {
-	w.buf = append(w.buf, p...)
-	return len(p), nil
+// Mkdir is a no-op, s3 has no directories
+func (c *s3client) Mkdir(ctx context.Context, path string) error {
+	return nil
 }
 
-func (w *s3Writer) Close() error {
-	r := bytes.NewReader(w.buf)
-	opts := minio.PutObjectOptions{}
-	if w.opts != nil {
-		// optionally set metadata keys with original mode and mtime
-		opts.UserMetadata = map[string]string{OriginalMtimeKey: w.opts.Mtime.Format(time.RFC3339),
-			OriginalModeKey: strconv.Itoa(int(w.opts.Mode))}
+// Rename copies the object (with its metadata) server side and deletes the source
+func (c *s3client) Rename(ctx context.Context, oldPath, newPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	srcBucket, srcObject := SplitPath(oldPath)
+	dstBucket, dstObject := SplitPath(newPath)
+	if err := c.copyObject(ctx, srcBucket, srcObject, dstBucket, dstObject, nil); err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s", oldPath, newPath)
+	}
+	return c.minioClient.RemoveObject(srcBucket, srcObject)
+}
 
-	objectName := w.path
+func (c *s3client) Writer(ctx context.Context, path string, opts *FileMeta) (io.WriteCloser, error) {
+	objectName := path
 	if strings.HasPrefix(objectName, "/") {
 		objectName = objectName[1:]
 	}
-	_, err := w.client.minioClient.PutObject(w.bucket, objectName, r, int64(len(w.buf)), opts)
+	return &s3Writer{
+		ctx:      ctx,
+		bucket:   c.params.Bucket,
+		path:     path,
+		object:   objectName,
+		client:   c,
+		opts:     opts,
+		partSize: s3PartSize(opts),
+		inflight: make(chan struct{}, S3MaxInflightParts),
+	}, nil
+}
+
+// s3PartSize returns S3PartSize, or the part size which splits the file to
+// S3MaxParts parts if the size hint of the file needs more parts
+func s3PartSize(opts *FileMeta) int64 {
+	if opts == nil || opts.Size <= int64(S3MaxParts)*S3PartSize {
+		return S3PartSize
+	}
+	return (opts.Size + int64(S3MaxParts) - 1) / int64(S3MaxParts)
+}
+
+// CanCopyFrom returns true if src is an s3 client of the same endpoint and
+// credentials, so objects can be copied server side
+func (c *s3client) CanCopyFrom(src FSClient) bool {
+	srcClient, ok := src.(*s3client)
+	return ok && srcClient.params.Endpoint == c.params.Endpoint && srcClient.params.Secure == c.params.Secure &&
+		srcClient.params.UserKey == c.params.UserKey && srcClient.params.Secret == c.params.Secret
+}
+
+// CopyFrom copies an object (bucket/key) server side, objects over 5GB are
+// copied with a multipart upload (UploadPartCopy), metadata is set as by Writer
+func (c *s3client) CopyFrom(ctx context.Context, src FSClient, srcPath, path string, opts *FileMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	srcBucket, srcObject := SplitPath(srcPath)
+	return c.copyObject(ctx, srcBucket, srcObject, c.params.Bucket, strings.TrimPrefix(path, "/"), s3Metadata(opts, ""))
+}
+
+// copyObject copies an object server side, the metadata replaces the source
+// metadata unless it is nil. objects over S3MaxCopySize are copied with a
+// multipart upload, ctx is checked between the parts and the upload is
+// aborted if a part fails
+func (c *s3client) copyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, metadata map[string]string) error {
+	stat, err := c.minioClient.StatObject(srcBucket, srcObject, minio.StatObjectOptions{})
 	if err != nil {
+		return err
+	}
+	core := minio.Core{Client: c.minioClient}
+	headers := map[string]string{}
+	for k, v := range metadata {
+		headers["X-Amz-Meta-"+k] = v
+	}
+	if stat.Size <= S3MaxCopySize {
+		if metadata != nil {
+			headers["X-Amz-Metadata-Directive"] = "REPLACE"
+		}
+		_, err := core.CopyObject(srcBucket, srcObject, dstBucket, dstObject, headers)
+		return err
+	}
+
+	// a multipart upload does not copy the source metadata
+	if metadata == nil {
+		for k, v := range stat.Metadata {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") && len(v) > 0 {
+				headers[k] = v[0]
+			}
+		}
+	}
+	uploadID, err := core.NewMultipartUpload(dstBucket, dstObject, minio.PutObjectOptions{UserMetadata: headers})
+	if err != nil {
+		return err
+	}
+	partSize := S3CopyPartSize
+	if minSize := (stat.Size + int64(S3MaxParts) - 1) / int64(S3MaxParts); minSize > partSize {
+		partSize = minSize
+	}
+	// fail the parts if the source changes during the copy
+	partHeaders := map[string]string{"X-Amz-Copy-Source-If-Match": stat.ETag}
+	var parts []minio.CompletePart
+	for offset, partNum := int64(0), 1; offset < stat.Size; offset, partNum = offset+partSize, partNum+1 {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		length := partSize
+		if offset+length > stat.Size {
+			length = stat.Size - offset
+		}
+		var part minio.CompletePart
+		part, err = core.CopyObjectPart(srcBucket, srcObject, dstBucket, dstObject, uploadID, partNum, offset, length, partHeaders)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to copy part %d of %s/%s", partNum, srcBucket, srcObject)
+			break
+		}
+		parts = append(parts, part)
+	}
+	if err == nil {
+		_, err = core.CompleteMultipartUpload(dstBucket, dstObject, uploadID, parts)
+	}
+	if err != nil {
+		if abortErr := core.AbortMultipartUpload(dstBucket, dstObject, uploadID); abortErr != nil {
+			c.logger.WarnWith("failed to abort copy upload", "bucket", dstBucket, "object", dstObject, "uploadId", uploadID, "err", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ResumeWriter continues a multipart upload from the last part completed in
+// sequence, the returned offset is the number of bytes already uploaded. a new
+// upload is started if state is nil or the upload no longer exists
+func (c *s3client) ResumeWriter(ctx context.Context, path string, opts *FileMeta, state *UploadState, onState func(*UploadState)) (io.WriteCloser, int64, error) {
+	writer, _ := c.Writer(ctx, path, opts)
+	w := writer.(*s3Writer)
+	w.keepOnError = true
+	w.onState = onState
+	if state == nil || state.UploadID == "" {
+		return w, 0, nil
+	}
+
+	core := minio.Core{Client: c.minioClient}
+	uploaded := map[int]minio.ObjectPart{}
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(w.bucket, w.object, state.UploadID, marker, 1000)
+		if err != nil {
+			c.logger.WarnWith("cannot resume upload, starting a new one",
+				"path", path, "uploadId", state.UploadID, "err", err)
+			c.AbortUpload(ctx, path, state)
+			return w, 0, nil
+		}
+		for _, part := range result.ObjectParts {
+			uploaded[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	// only a sequence of full parts from the first part can be reused
+	w.uploadID = state.UploadID
+	w.partSize = state.PartSize
+	for part, ok := uploaded[1]; ok && part.Size == w.partSize; part, ok = uploaded[w.partNum+1] {
+		w.partNum++
+		w.parts = append(w.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	c.logger.DebugWith("resume upload", "path", path, "uploadId", w.uploadID, "parts", w.partNum)
+	return w, int64(w.partNum) * w.partSize, nil
+}
+
+// AbortUpload aborts a multipart upload which will not be resumed so its parts
+// are not left in the bucket, uploads which no longer exist are ignored
+func (c *s3client) AbortUpload(ctx context.Context, path string, state *UploadState) error {
+	core := minio.Core{Client: c.minioClient}
+	err := core.AbortMultipartUpload(c.params.Bucket, strings.TrimPrefix(path, "/"), state.UploadID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		c.logger.WarnWith("failed to abort stale upload", "path", path, "uploadId", state.UploadID, "err", err)
+		return errors.Wrapf(err, "failed to abort upload %s of %s", state.UploadID, path)
+	}
+	return nil
+}
+
+// s3Writer buffers a single part at a time, small objects are written with one
+// PutObject on Close, larger ones are streamed as a multipart upload
+type s3Writer struct {
+	ctx      context.Context
+	bucket   string
+	path     string
+	object   string
+	buf      []byte
+	opts     *FileMeta
+	client   *s3client
+	partSize int64
+
+	uploadID string
+	partNum  int
+	inflight chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	parts    []minio.CompletePart
+	err      error
+	aborted  bool
+	etag     string
+	checksum string
+
+	// resumable uploads are kept (not aborted) on errors, and report the
+	// upload when started and every completed part
+	keepOnError bool
+	onState     func(*UploadState)
+}
+
+func (w *s3Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err := w.uploadErr(); err != nil {
+			w.Abort()
+			return n, err
+		}
+		if err := w.ctx.Err(); err != nil {
+			w.Abort()
+			return n, err
+		}
+
+		if len(w.buf) == 0 && w.partNum >= S3MaxParts {
+			// fail before buffering data which cannot be uploaded
+			err := fmt.Errorf("%s is larger than %d parts of %d bytes (the s3 limit)", w.path, S3MaxParts, w.partSize)
+			w.Abort()
+			return n, err
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.partSize)
+		}
+		chunk := int(w.partSize) - len(w.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		w.buf = append(w.buf, p[:chunk]...)
+		n += chunk
+		p = p[chunk:]
+
+		if int64(len(w.buf)) >= w.partSize {
+			if err := w.uploadPart(); err != nil {
+				w.Abort()
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *s3Writer) metadata() map[string]string {
+	return s3Metadata(w.opts, w.checksum)
+}
+
+// s3Metadata returns the object user metadata for the file options and checksum
+func s3Metadata(opts *FileMeta, checksum string) map[string]string {
+	meta := map[string]string{}
+	if opts != nil && !opts.Mtime.IsZero() {
+		// optionally set metadata keys with original mode and mtime
+		meta[OriginalMtimeKey] = opts.Mtime.Format(time.RFC3339)
+		meta[OriginalModeKey] = strconv.Itoa(int(opts.Mode))
+	}
+	if checksum != "" {
+		meta[ChecksumKey] = checksum
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+func (w *s3Writer) putOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{UserMetadata: w.metadata()}
+}
+
+func (w *s3Writer) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// uploadPart sends the current buffer as the next part, blocks while the
+// number of in-flight parts is at the limit
+func (w *s3Writer) uploadPart() error {
+	core := minio.Core{Client: w.client.minioClient}
+	if w.uploadID == "" {
+		uploadID, err := core.NewMultipartUpload(w.bucket, w.object, w.putOptions())
+		if err != nil {
+			return errors.Wrapf(err, "failed to start multipart upload for %s", w.path)
+		}
+		w.uploadID = uploadID
+		if w.onState != nil {
+			w.onState(&UploadState{UploadID: w.uploadID, PartSize: w.partSize})
+		}
+	}
+
+	w.partNum++
+	partNum, data := w.partNum, w.buf
+	w.buf = nil
+
+	w.inflight <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.inflight
+			w.wg.Done()
+		}()
+
+		part, err := core.PutObjectPart(w.bucket, w.object, w.uploadID, partNum,
+			newContextReadSeeker(w.ctx, bytes.NewReader(data)), int64(len(data)), "", "", nil)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = errors.Wrapf(err, "failed to upload part %d of %s", partNum, w.path)
+			}
+			return
+		}
+		w.parts = append(w.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		if w.onState != nil {
+			w.onState(&UploadState{UploadID: w.uploadID, PartSize: w.partSize,
+				Parts: []UploadPart{{Number: part.PartNumber, ETag: part.ETag}}})
+		}
+	}()
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.aborted {
+		return fmt.Errorf("write to %s was aborted", w.path)
+	}
+
+	core := minio.Core{Client: w.client.minioClient}
+	if w.uploadID == "" {
+		info, err := core.PutObject(w.bucket, w.object, newContextReadSeeker(w.ctx, bytes.NewReader(w.buf)),
+			int64(len(w.buf)), "", "", w.metadata(), nil)
+		w.buf = nil
+		if err != nil {
+			w.client.logger.Error("obj %s put error (%v)", w.path, err)
+		}
+		w.etag = info.ETag
+		return err
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.wg.Wait()
+	if err := w.uploadErr(); err != nil {
 		w.client.logger.Error("obj %s put error (%v)", w.path, err)
+		w.Abort()
+		return err
+	}
+
+	sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].PartNumber < w.parts[j].PartNumber })
+	etag, err := core.CompleteMultipartUpload(w.bucket, w.object, w.uploadID, w.parts)
+	w.etag = etag
+	if err != nil {
+		w.client.logger.Error("obj %s complete multipart error (%v)", w.path, err)
+		w.Abort()
+		return err
+	}
+	w.uploadID = ""
+
+	if w.checksum != "" {
+		// the checksum is only known after the upload was started, a copy to
+		// itself replaces the object metadata (and etag). the copy costs a server
+		// side read and write of the object, documented with -verify
+		w.etag = ""
+		if err := w.replaceMetadata(); err != nil {
+			w.client.logger.Error("obj %s set checksum metadata error (%v)", w.path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *s3Writer) replaceMetadata() error {
+	return w.client.copyObject(w.ctx, w.bucket, w.object, w.bucket, w.object, w.metadata())
+}
+
+// ETag returns the object etag after a successful Close (empty if unknown)
+func (w *s3Writer) ETag() string {
+	return w.etag
+}
+
+// SetChecksum stores the checksum in the object user metadata
+func (w *s3Writer) SetChecksum(checksum string) {
+	w.checksum = checksum
+}
+
+// Abort discards the buffered data and aborts the multipart upload (if started)
+// so no orphaned parts are left in the bucket, resumable uploads are kept
+func (w *s3Writer) Abort() error {
+	w.aborted = true
+	w.buf = nil
+	w.wg.Wait()
+	if w.uploadID == "" || w.keepOnError {
+		return nil
+	}
+
+	core := minio.Core{Client: w.client.minioClient}
+	err := core.AbortMultipartUpload(w.bucket, w.object, w.uploadID)
+	if err != nil {
+		w.client.logger.Error("obj %s abort multipart error (%v)", w.path, err)
 	}
+	w.uploadID = ""
 	return err
 }
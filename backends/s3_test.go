@@ -0,0 +1,445 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"github.com/nuclio/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the requests of a listing, a server side copy and a multipart
+// upload, objects have the size given in objectSizes and the original mtime
+// (and a checksum) in objectMtimes, the deleted objects are listed but not
+// found. uploaded parts are counted, the part number failPart fails (also when
+// copied) and the part number retryPart fails once with a retryable error
+type fakeS3 struct {
+	lock         sync.Mutex
+	objectSizes  map[string]int64
+	objectMtimes map[string]string
+	deleted      map[string]int64
+	copies       []http.Header
+	copyParts    []string
+	completed    bool
+
+	failPart    string
+	retryPart   string
+	parts       int
+	inflight    int
+	maxInflight int
+	aborted     []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.Method == http.MethodPut && query.Get("partNumber") != "" && r.Header.Get("X-Amz-Copy-Source") == "" {
+		f.uploadPart(w, r)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case r.Method == http.MethodHead:
+		size, ok := f.objectSizes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if mtime, ok := f.objectMtimes[r.URL.Path]; ok {
+			w.Header().Set(OriginalMtimeS3Key, mtime)
+			w.Header().Set(OriginalModeS3Key, "420")
+			w.Header().Set(ChecksumS3Key, "md5:abc")
+		}
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for _, objects := range []map[string]int64{f.objectSizes, f.deleted} {
+			for key, size := range objects {
+				if strings.HasPrefix(key, r.URL.Path) {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+						strings.TrimPrefix(key, r.URL.Path), time.Now().UTC().Format(time.RFC3339), size)
+				}
+			}
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	case r.Method == http.MethodPost && query.Get("uploadId") == "":
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload1</UploadId></InitiateMultipartUploadResult>`)
+		f.copies = append(f.copies, r.Header)
+	case r.Method == http.MethodPost:
+		f.completed = true
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>dst-bucket</Bucket><ETag>"abc-2"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "" && query.Get("partNumber") == f.failPart:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		f.copyParts = append(f.copyParts, r.Header.Get("X-Amz-Copy-Source-Range"))
+		fmt.Fprint(w, `<CopyPartResult><ETag>"part"</ETag></CopyPartResult>`)
+	case r.Method == http.MethodPut:
+		f.copies = append(f.copies, r.Header)
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"abc"</ETag></CopyObjectResult>`)
+	case r.Method == http.MethodGet && query.Get("uploadId") != "":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchUpload</Code><Message>no such upload</Message></Error>`)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		f.aborted = append(f.aborted, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// uploadPart accepts a part after a short delay (without holding the lock) so
+// the concurrent parts can be counted
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.inflight++
+	if f.inflight > f.maxInflight {
+		f.maxInflight = f.inflight
+	}
+	f.lock.Unlock()
+	ioutil.ReadAll(r.Body)
+	time.Sleep(10 * time.Millisecond)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inflight--
+	if r.URL.Query().Get("partNumber") == f.failPart {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+		return
+	}
+	if r.URL.Query().Get("partNumber") == f.retryPart {
+		f.retryPart = ""
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>slow down</Message></Error>`)
+		return
+	}
+	f.parts++
+	w.Header().Set("ETag", fmt.Sprintf(`"part%s"`, r.URL.Query().Get("partNumber")))
+}
+
+func newTestS3Client(t *testing.T, endpoint, bucket, secret string) *s3client {
+	logger, _ := nucliozap.NewNuclioZapCmd("test", nucliozap.ErrorLevel)
+	params := PathParams{Kind: "s3", Endpoint: endpoint, Bucket: bucket, UserKey: "key", Secret: secret, Tag: "us-east-1"}
+	client, err := NewS3Client(logger, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*s3client)
+}
+
+func TestS3ServerSideCopy(t *testing.T) {
+	fake := &fakeS3{objectSizes: map[string]int64{"/src-bucket/a.csv": 100, "/src-bucket/big.bin": 6 << 30}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+
+	src := newTestS3Client(t, endpoint, "src-bucket", "secret")
+	dst := newTestS3Client(t, endpoint, "dst-bucket", "secret")
+	if !dst.CanCopyFrom(src) {
+		t.Fatalf("expected a server side copy on the same endpoint and credentials")
+	}
+	if dst.CanCopyFrom(newTestS3Client(t, endpoint, "src-bucket", "other")) {
+		t.Fatalf("expected no server side copy with other credentials")
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := dst.CopyFrom(context.Background(), src, "src-bucket/a.csv", "/dir/a.csv", &FileMeta{Mtime: mtime, Mode: 0644})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := fake.copies[0]
+	if headers.Get("X-Amz-Copy-Source") != "src-bucket/a.csv" || headers.Get("X-Amz-Metadata-Directive") != "REPLACE" ||
+		headers.Get(OriginalMtimeS3Key) != mtime.Format(time.RFC3339) {
+		t.Fatalf("unexpected copy headers %v", headers)
+	}
+
+	// objects over 5GB are copied in parts
+	err = dst.CopyFrom(context.Background(), src, "src-bucket/big.bin", "big.bin", &FileMeta{Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.copyParts) < 2 || !fake.completed {
+		t.Fatalf("expected a multipart copy, got parts %v", fake.copyParts)
+	}
+	if fake.copies[1].Get(OriginalMtimeS3Key) != mtime.Format(time.RFC3339) {
+		t.Fatalf("expected the metadata on the multipart upload, got %v", fake.copies[1])
+	}
+}
+
+func TestS3ServerSideCopyAbort(t *testing.T) {
+	fake := &fakeS3{objectSizes: map[string]int64{"/src-bucket/big.bin": 6 << 30}, failPart: "3"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	src := newTestS3Client(t, endpoint, "src-bucket", "secret")
+	dst := newTestS3Client(t, endpoint, "dst-bucket", "secret")
+
+	err := dst.CopyFrom(context.Background(), src, "src-bucket/big.bin", "big.bin", nil)
+	if err == nil {
+		t.Fatal("expected the failed part to fail the copy")
+	}
+	if len(fake.copyParts) != 2 || fake.completed || len(fake.aborted) != 1 {
+		t.Fatalf("expected the copy to stop and abort at part 3, got parts %v, aborts %v", fake.copyParts, fake.aborted)
+	}
+
+	// a canceled copy does not start the upload
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dst.CopyFrom(ctx, src, "src-bucket/big.bin", "big.bin", nil); err != context.Canceled {
+		t.Fatalf("expected a canceled copy, got %v", err)
+	}
+	if len(fake.copies) != 1 {
+		t.Fatalf("expected no new upload after cancel, got %d", len(fake.copies))
+	}
+}
+
+func TestS3ListWithMeta(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := &fakeS3{
+		objectSizes:  map[string]int64{"/src-bucket/a.csv": 100, "/src-bucket/b.csv": 10, "/src-bucket/new.csv": 10},
+		objectMtimes: map[string]string{"/src-bucket/a.csv": mtime.Format(time.RFC3339), "/src-bucket/b.csv": mtime.Format(time.RFC3339)},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "src-bucket", "secret")
+
+	// the time filter applies to the original mtime, new.csv has no stored mtime
+	task := ListDirTask{Source: client.params, WithMeta: true, Since: mtime.Add(time.Hour)}
+	fileChan := make(chan *FileDetails, 10)
+	summary := ListSummary{}
+	if err := client.ListDir(context.Background(), fileChan, &task, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalFiles != 1 {
+		t.Fatalf("expected only new.csv to be listed, got %d files", summary.TotalFiles)
+	}
+	if f := <-fileChan; f.Key != "src-bucket/new.csv" {
+		t.Fatalf("unexpected file %+v", f)
+	}
+
+	task.Since = time.Time{}
+	fileChan = make(chan *FileDetails, 10)
+	if err := client.ListDir(context.Background(), fileChan, &task, &ListSummary{}); err != nil {
+		t.Fatal(err)
+	}
+	for f := range fileChan {
+		if f.Key != "src-bucket/new.csv" && (!f.Mtime.Equal(mtime) || f.Mode != 0644) {
+			t.Fatalf("expected the original mtime and mode, got %+v", f)
+		}
+	}
+
+	f, err := client.Stat(context.Background(), "src-bucket/a.csv")
+	if err != nil || !f.Mtime.Equal(mtime) || f.Size != 100 || f.Checksum != "md5:abc" {
+		t.Fatalf("unexpected stat %+v (%v)", f, err)
+	}
+	if _, err := client.Stat(context.Background(), "src-bucket/missing.csv"); !IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestS3ListWithMetaDeleted(t *testing.T) {
+	fake := &fakeS3{
+		objectSizes: map[string]int64{"/src-bucket/a.csv": 100, "/src-bucket/b.csv": 10},
+		deleted:     map[string]int64{"/src-bucket/gone.csv": 10},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "src-bucket", "secret")
+
+	// an object deleted after it was listed is skipped, the listing goes on
+	task := ListDirTask{Source: client.params, WithMeta: true}
+	fileChan := make(chan *FileDetails, 10)
+	summary := ListSummary{}
+	if err := client.ListDir(context.Background(), fileChan, &task, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalFiles != 2 || summary.TotalBytes != 110 {
+		t.Fatalf("expected a.csv and b.csv to be listed, got %+v", summary)
+	}
+	for f := range fileChan {
+		if f.Key == "src-bucket/gone.csv" {
+			t.Fatalf("unexpected deleted file %+v", f)
+		}
+	}
+}
+
+func TestS3MultipartWrite(t *testing.T) {
+	defer func(size int64, inflight int) {
+		S3PartSize, S3MaxInflightParts = size, inflight
+	}(S3PartSize, S3MaxInflightParts)
+	S3PartSize, S3MaxInflightParts = 10, 2
+
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "dst-bucket", "secret")
+
+	w, err := client.Writer(context.Background(), "big.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// the parts are uploaded while writing, only the in-flight parts are left
+	fake.lock.Lock()
+	streamed := fake.parts
+	fake.lock.Unlock()
+	if streamed < 10-S3MaxInflightParts {
+		t.Fatalf("expected the parts to be uploaded while writing, got %d parts before close", streamed)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.parts != 10 || !fake.completed || len(fake.aborted) != 0 {
+		t.Fatalf("expected a completed upload of 10 parts, got %d parts", fake.parts)
+	}
+	if fake.maxInflight > S3MaxInflightParts {
+		t.Fatalf("expected at most %d parts in flight, got %d", S3MaxInflightParts, fake.maxInflight)
+	}
+}
+
+func TestS3MultipartWriteAbort(t *testing.T) {
+	defer func(size int64) { S3PartSize = size }(S3PartSize)
+	S3PartSize = 10
+
+	fake := &fakeS3{failPart: "3"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "dst-bucket", "secret")
+
+	w, err := client.Writer(context.Background(), "big.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(make([]byte, 100))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		t.Fatal("expected the failed part to fail the write")
+	}
+	if len(fake.aborted) != 1 || fake.completed {
+		t.Fatal("expected the multipart upload to be aborted")
+	}
+	if w.Close() == nil {
+		t.Fatal("expected close to fail after an abort")
+	}
+}
+
+func TestS3MultipartPartLimit(t *testing.T) {
+	defer func(size int64, maxParts int) { S3PartSize, S3MaxParts = size, maxParts }(S3PartSize, S3MaxParts)
+	S3PartSize, S3MaxParts = 10, 5
+
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "dst-bucket", "secret")
+
+	// the size hint raises the part size so the file fits in S3MaxParts parts
+	w, err := client.Writer(context.Background(), "big.bin", &FileMeta{Size: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 95)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.parts != 5 || !fake.completed {
+		t.Fatalf("expected 5 parts of 19 bytes, got %d parts", fake.parts)
+	}
+
+	// without a hint the write fails once the parts are used up
+	fake = &fakeS3{}
+	server2 := httptest.NewServer(fake)
+	defer server2.Close()
+	client = newTestS3Client(t, strings.TrimPrefix(server2.URL, "http://"), "dst-bucket", "secret")
+	w, err = client.Writer(context.Background(), "big.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := w.Write(make([]byte, 100))
+	if err == nil || !strings.Contains(err.Error(), "5 parts") {
+		t.Fatalf("expected the part limit to fail the write, got %v", err)
+	}
+	if n != 50 || fake.parts != 5 || len(fake.aborted) != 1 {
+		t.Fatalf("expected 50 bytes in 5 parts and an abort, got %d bytes, %d parts, aborts %v", n, fake.parts, fake.aborted)
+	}
+}
+
+func TestS3MultipartWriteRetry(t *testing.T) {
+	defer func(size int64) { S3PartSize = size }(S3PartSize)
+	S3PartSize = 10
+
+	// the part body is seekable so minio retries the failed part
+	fake := &fakeS3{retryPart: "2"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "dst-bucket", "secret")
+
+	w, err := client.Writer(context.Background(), "big.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.parts != 3 || !fake.completed || len(fake.aborted) != 0 {
+		t.Fatalf("expected the part to be retried, got %d parts", fake.parts)
+	}
+}
+
+func TestS3ResumeStaleUpload(t *testing.T) {
+	defer func(size int64) { S3PartSize = size }(S3PartSize)
+	S3PartSize = 10
+
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestS3Client(t, strings.TrimPrefix(server.URL, "http://"), "dst-bucket", "secret")
+
+	// the old upload no longer exists, it is aborted and a new one is started
+	var states []*UploadState
+	w, offset, err := client.ResumeWriter(context.Background(), "big.bin", nil, &UploadState{UploadID: "old", PartSize: 10},
+		func(state *UploadState) { states = append(states, state) })
+	if err != nil || offset != 0 {
+		t.Fatalf("expected a new upload, got offset %d (%v)", offset, err)
+	}
+	if len(fake.aborted) != 1 || fake.aborted[0] != "old" {
+		t.Fatalf("expected the stale upload to be aborted, got %v", fake.aborted)
+	}
+	if _, err := w.Write(make([]byte, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload start and then only the new part of every completed part
+	if len(states) != 4 || states[0].UploadID != "upload1" || len(states[0].Parts) != 0 {
+		t.Fatalf("unexpected upload states %v", states)
+	}
+	for _, state := range states[1:] {
+		if len(state.Parts) != 1 {
+			t.Fatalf("expected a single part per state, got %v", state.Parts)
+		}
+	}
+
+	if err := client.AbortUpload(context.Background(), "big.bin", &UploadState{UploadID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+}
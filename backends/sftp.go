@@ -0,0 +1,334 @@
+package backends
+
+import (
+	"context"
+	"github.com/nuclio/logger"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SSHKeyFileEnvironmentVariable    = "SSH_KEY_FILE"
+	SSHPassphraseEnvironmentVariable = "SSH_KEY_PASSPHRASE"
+	SSHAgentEnvironmentVariable      = "SSH_AUTH_SOCK"
+	SSHKnownHostsEnvironmentVariable = "SSH_KNOWN_HOSTS"
+	SSHInsecureEnvironmentVariable   = "SSH_INSECURE"
+)
+
+const defaultSSHPort = "22"
+
+// SSHTimeout is the max time to wait for the ssh connection to be established
+var SSHTimeout = 30 * time.Second
+
+type SftpClient struct {
+	params *PathParams
+	logger logger.Logger
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// parseSftpURL parses sftp(scp)://<host>[:<port>]/path URLs, paths are absolute
+// unless they start with ~/ (relative to the user home)
+func parseSftpURL(u *url.URL, params *PathParams) error {
+	params.Endpoint = u.Host
+	if strings.HasPrefix(params.Path, "~/") {
+		params.Path = params.Path[2:]
+	} else {
+		params.Path = "/" + params.Path
+	}
+	return nil
+}
+
+// NewSftpClient connects to an ssh server and opens an sftp session, used for
+// both sftp:// and scp:// urls. the scp client in hack/ only uploads (buffering
+// the whole file) and cannot list, read or stat files, so scp:// needs the
+// server sftp subsystem
+func NewSftpClient(logger logger.Logger, params *PathParams) (FSClient, error) {
+	if params.UserKey == "" {
+		params.UserKey = os.Getenv("USER")
+	}
+	if params.Secret == "" {
+		params.Secret = params.Token
+	}
+	params.Path = path.Clean(params.Path)
+
+	auth, agentConn, err := sshAuthMethods(params)
+	if err != nil {
+		return nil, err
+	}
+	if agentConn != nil {
+		// the agent is only used to sign the authentication
+		defer agentConn.Close()
+	}
+	hostKeyCallback, err := sshHostKeyCallback(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	host := params.Endpoint
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultSSHPort)
+	}
+	config := ssh.ClientConfig{
+		User:            params.UserKey,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         SSHTimeout,
+	}
+	conn, err := ssh.Dial("tcp", host, &config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to ssh server %s", host)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to start sftp session with %s", host)
+	}
+
+	return &SftpClient{params: params, logger: logger, conn: conn, client: client}, nil
+}
+
+// sshAuthMethods returns the password (from the url), private key file and
+// ssh-agent auth methods, in that order, and the agent connection (if used)
+func sshAuthMethods(params *PathParams) ([]ssh.AuthMethod, net.Conn, error) {
+	methods := []ssh.AuthMethod{}
+	if params.Secret != "" {
+		methods = append(methods, ssh.Password(params.Secret))
+	}
+
+	if keyFile := os.Getenv(SSHKeyFileEnvironmentVariable); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read ssh key file %s", keyFile)
+		}
+
+		var signer ssh.Signer
+		if passphrase := os.Getenv(SSHPassphraseEnvironmentVariable); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse ssh key file %s", keyFile)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	var agentConn net.Conn
+	if socket := os.Getenv(SSHAgentEnvironmentVariable); socket != "" {
+		var err error
+		agentConn, err = net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to connect to ssh agent %s", socket)
+		}
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no ssh credentials, set a password in the url, " +
+			SSHKeyFileEnvironmentVariable + " or " + SSHAgentEnvironmentVariable)
+	}
+	return methods, agentConn, nil
+}
+
+// sshHostKeyCallback verifies host keys against the known_hosts file, it fails
+// if the file does not exist unless SSH_INSECURE=1 disables the verification
+func sshHostKeyCallback(logger logger.Logger) (ssh.HostKeyCallback, error) {
+	if insecure, _ := strconv.ParseBool(os.Getenv(SSHInsecureEnvironmentVariable)); insecure {
+		logger.Warn("%s is set, ssh host keys will not be verified", SSHInsecureEnvironmentVariable)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHostsFile := os.Getenv(SSHKnownHostsEnvironmentVariable)
+	if knownHostsFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+	}
+
+	if _, err := os.Stat(knownHostsFile); err != nil {
+		return nil, errors.Errorf("known hosts file %s not found, set %s or %s=1 to skip the host key verification",
+			knownHostsFile, SSHKnownHostsEnvironmentVariable, SSHInsecureEnvironmentVariable)
+	}
+	return knownhosts.New(knownHostsFile)
+}
+
+// Close ends the sftp session and then closes the ssh connection
+func (c *SftpClient) Close() error {
+	c.client.Close()
+	return c.conn.Close()
+}
+
+func (c *SftpClient) ListDir(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+	defer close(fileChan)
+
+	walker := c.client.Walk(c.params.Path)
+	for walker.Step() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := walker.Err(); err != nil {
+			c.logger.Error("List walk error with path %s, %v", walker.Path(), err)
+			return err
+		}
+		remotePath, fi := walker.Path(), walker.Stat()
+
+		if fi.IsDir() {
+			if remotePath != c.params.Path && (!task.IsRecursive() || (!task.Hidden && strings.HasPrefix(fi.Name(), ".")) ||
+				!task.matchDir(relativeKey(c.params.Path, remotePath))) {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if !IsMatch(task, relativeFileKey(c.params.Path, remotePath), fi.ModTime(), fi.Size()) {
+			continue
+		}
+
+		fileDetails := &FileDetails{
+			Key: remotePath, Size: fi.Size(), Mtime: fi.ModTime(), Mode: uint32(fi.Mode().Perm()),
+		}
+		c.logger.DebugWith("List file", "key", remotePath,
+			"modified", fi.ModTime(), "size", fi.Size(), "mode", uint32(fi.Mode()))
+
+		summary.TotalBytes += fi.Size()
+		summary.TotalFiles += 1
+		select {
+		case fileChan <- fileDetails:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (c *SftpClient) Reader(ctx context.Context, path string) (FSReader, error) {
+	f, err := c.client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpReader{f}, nil
+}
+
+type sftpReader struct {
+	f *sftp.File
+}
+
+func (r *sftpReader) Read(p []byte) (n int, err error) {
+	return r.f.Read(p)
+}
+
+func (r *sftpReader) Close() error {
+	return r.f.Close()
+}
+
+func (r *sftpReader) Stat() (*FileMeta, error) {
+	stat, err := r.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	meta := FileMeta{Mtime: stat.ModTime(), Mode: uint32(stat.Mode().Perm())}
+	return &meta, nil
+}
+
+func (c *SftpClient) Stat(ctx context.Context, path string) (*FileDetails, error) {
+	fi, err := c.client.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrNotFound, path)
+	} else if err != nil {
+		return nil, err
+	}
+	return &FileDetails{Key: path, Size: fi.Size(), Mtime: fi.ModTime(), Mode: uint32(fi.Mode().Perm())}, nil
+}
+
+func (c *SftpClient) Delete(ctx context.Context, path string) error {
+	err := c.client.Remove(path)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	return err
+}
+
+func (c *SftpClient) Mkdir(ctx context.Context, path string) error {
+	return c.client.MkdirAll(path)
+}
+
+func (c *SftpClient) Rename(ctx context.Context, oldPath, newPath string) error {
+	if err := c.client.MkdirAll(path.Dir(newPath)); err != nil {
+		return err
+	}
+	err := c.client.PosixRename(oldPath, newPath)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, oldPath)
+	}
+	return err
+}
+
+func (c *SftpClient) Writer(ctx context.Context, path string, opts *FileMeta) (io.WriteCloser, error) {
+	if dir, _ := filepath.Split(path); dir != "" {
+		if err := c.client.MkdirAll(dir); err != nil {
+			return nil, errors.Wrapf(err, "failed to create remote dir %s", dir)
+		}
+	}
+
+	f, err := c.client.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{f: f, path: path, opts: opts, client: c.client}, nil
+}
+
+type sftpWriter struct {
+	f      *sftp.File
+	path   string
+	opts   *FileMeta
+	client *sftp.Client
+}
+
+func (w *sftpWriter) Write(p []byte) (n int, err error) {
+	return w.f.Write(p)
+}
+
+func (w *sftpWriter) Close() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if w.opts == nil {
+		return nil
+	}
+
+	if w.opts.Mode > 0 {
+		if err := w.client.Chmod(w.path, os.FileMode(w.opts.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if !w.opts.Mtime.IsZero() {
+		return w.client.Chtimes(w.path, w.opts.Mtime, w.opts.Mtime)
+	}
+	return nil
+}
+
+// Abort closes and removes the partially written remote file
+func (w *sftpWriter) Abort() error {
+	w.f.Close()
+	return w.client.Remove(w.path)
+}
@@ -1,11 +1,14 @@
 package backends
 
 import (
+	"context"
 	"fmt"
-	"github.com/nuclio/logger"
+	"github.com/pkg/errors"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -19,22 +22,33 @@ const OriginalModeS3Key = "X-Amz-Meta-Original_mode"
 type ListDirTask struct {
 	Source    *PathParams
 	Since     time.Time
+	Until     time.Time
 	MinSize   int64
 	MaxSize   int64
 	Recursive bool
 	InclEmpty bool
 	Hidden    bool
 	WithMeta  bool
+	// include/exclude patterns of the paths relative to the listed directory
+	Filter *Filter
+	// regular expression of the paths relative to the listed directory
+	PathRegexp *regexp.Regexp
+	// depth limits of the files, the files in the listed directory are at depth
+	// 1 (0 is not limited), the walkers do not list directories below MaxDepth
+	MinDepth int
+	MaxDepth int
 
 	dir    string
 	filter string
 }
 
 type FileDetails struct {
-	Key   string
-	Mtime time.Time
-	Mode  uint32
-	Size  int64
+	Key   string    `json:"key"`
+	Mtime time.Time `json:"mtime"`
+	Mode  uint32    `json:"mode,omitempty"`
+	Size  int64     `json:"size"`
+	// checksum stored with the object ("<algo>:<hex>"), set by Stat if any
+	Checksum string `json:"checksum,omitempty"`
 }
 
 type ListSummary struct {
@@ -54,23 +68,113 @@ type PathParams struct {
 	Token    string `json:"token,omitempty"`
 
 	filter string
-	isFile bool
+	// the filter pattern of the path below the listed dir, if the filter has
+	// directory components
+	pathFilter *regexp.Regexp
+	isFile     bool
 }
 
 func (p *PathParams) String() string {
 	return fmt.Sprintf("%s://%s/%s/%s", p.Kind, p.Endpoint, p.Bucket, p.Path)
 }
 
+// Redacted returns a copy of the params without the secret and token
+func (p *PathParams) Redacted() *PathParams {
+	redacted := *p
+	redacted.Secret, redacted.Token = "", ""
+	return &redacted
+}
+
 type FileMeta struct {
 	Mtime time.Time
 	Mode  uint32
 	Attrs map[string]interface{}
+	// checksum stored with the object ("<algo>:<hex>"), if any
+	Checksum string
+	// the expected size of a written file (0 if unknown), a hint for writers
+	// which split the file to parts
+	Size int64
 }
 
+// ErrNotFound is returned (wrapped) by Stat when the file does not exist
+var ErrNotFound = errors.New("file not found")
+
+// ErrNotSupported is returned by operations which a backend does not support
+var ErrNotSupported = errors.New("operation not supported")
+
+// IsNotFound returns true if the error is (or wraps) ErrNotFound
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrNotFound
+}
+
+// FSClient is a storage backend, the context cancels the listing and the
+// reader/writer requests. Stat, Delete, Mkdir and Rename take the keys returned
+// by ListDir (s3 keys include the bucket name). clients which hold connections
+// also implement io.Closer, see CloseClient
 type FSClient interface {
-	ListDir(fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error
-	Reader(path string) (FSReader, error)
-	Writer(path string, opts *FileMeta) (io.WriteCloser, error)
+	ListDir(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error
+	Reader(ctx context.Context, path string) (FSReader, error)
+	Writer(ctx context.Context, path string, opts *FileMeta) (io.WriteCloser, error)
+	// Stat returns the details of a single file, ErrNotFound if it does not exist
+	Stat(ctx context.Context, path string) (*FileDetails, error)
+	Delete(ctx context.Context, path string) error
+	// Mkdir creates a directory and its parents, a no-op for object stores
+	Mkdir(ctx context.Context, path string) error
+	// Rename moves a file to a new key, ErrNotSupported if the backend cannot
+	Rename(ctx context.Context, oldPath, newPath string) error
+}
+
+// CloseClient closes the connections of a client (if it has any)
+func CloseClient(client FSClient) error {
+	if closer, ok := client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// FSServerCopier is implemented by clients which can copy files from another
+// client (e.g. the same s3 endpoint) without streaming the data through xcp
+type FSServerCopier interface {
+	CanCopyFrom(src FSClient) bool
+	CopyFrom(ctx context.Context, src FSClient, srcPath, path string, opts *FileMeta) error
+}
+
+// UploadState is the completed parts of a partial (multipart) upload
+type UploadState struct {
+	UploadID string       `json:"uploadId"`
+	PartSize int64        `json:"partSize"`
+	Parts    []UploadPart `json:"parts,omitempty"`
+}
+
+type UploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// FSResumer is implemented by clients which can resume a partial upload, the
+// returned offset is the number of bytes already written. onState is called
+// when the upload is started and with every completed part (only the new part).
+// AbortUpload discards a partial upload which will not be resumed
+type FSResumer interface {
+	ResumeWriter(ctx context.Context, path string, opts *FileMeta, state *UploadState, onState func(*UploadState)) (io.WriteCloser, int64, error)
+	AbortUpload(ctx context.Context, path string, state *UploadState) error
+}
+
+// FSETagger is implemented by writers which return the destination etag
+type FSETagger interface {
+	ETag() string
+}
+
+// FSChecksummer is implemented by writers which store the content checksum
+// ("<algo>:<hex>") as object metadata, set before Close
+type FSChecksummer interface {
+	SetChecksum(checksum string)
+}
+
+// FSAborter is implemented by writers which can discard a partially written
+// object instead of committing it on Close
+type FSAborter interface {
+	Abort() error
 }
 
 type FSReader interface {
@@ -79,17 +183,37 @@ type FSReader interface {
 	Stat() (*FileMeta, error)
 }
 
-func GetNewClient(logger logger.Logger, params *PathParams) (FSClient, error) {
-	switch strings.ToLower(params.Kind) {
-	case "v3io":
-		return NewV3ioClient(logger, params)
-	case "s3":
-		return NewS3Client(logger, params)
-	case "", "file":
-		return NewLocalClient(logger, params)
-	default:
-		return nil, fmt.Errorf("Unknown backend %s use s3, v3io or local", params.Kind)
+// NewContextReader returns a reader which fails with the context error once
+// the context is done
+func NewContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return r.reader.Read(p)
+}
+
+// newContextReadSeeker is a context reader which keeps the Seek of the reader,
+// minio only retries requests with a seekable body
+func newContextReadSeeker(ctx context.Context, reader io.ReadSeeker) io.ReadSeeker {
+	return &contextReadSeeker{contextReader: contextReader{ctx: ctx, reader: reader}, seeker: reader}
+}
+
+type contextReadSeeker struct {
+	contextReader
+	seeker io.Seeker
+}
+
+func (r *contextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
 }
 
 func ValidFSTarget(filePath string) error {
@@ -128,7 +252,10 @@ func defaultFromEnv(param string, envvar string) string {
 	return param
 }
 
-func IsMatch(task *ListDirTask, name string, mtime time.Time, size int64) bool {
+// IsMatch returns true if a file (path relative to the listed directory)
+// matches the task filters
+func IsMatch(task *ListDirTask, relPath string, mtime time.Time, size int64) bool {
+	name := path.Base(relPath)
 	if !task.InclEmpty && size == 0 {
 		return false
 	}
@@ -141,11 +268,31 @@ func IsMatch(task *ListDirTask, name string, mtime time.Time, size int64) bool {
 		return false
 	}
 
+	if !task.Until.IsZero() && mtime.After(task.Until) {
+		return false
+	}
+
 	if (size < task.MinSize) || (task.MaxSize > 0 && size > task.MaxSize) {
 		return false
 	}
 
-	if task.Source.filter != "" {
+	if depth := pathDepth(relPath); depth < task.MinDepth || (task.MaxDepth > 0 && depth > task.MaxDepth) {
+		return false
+	}
+
+	if task.PathRegexp != nil && !task.PathRegexp.MatchString(strings.Trim(relPath, "/")) {
+		return false
+	}
+
+	if !task.Filter.Match(relPath) {
+		return false
+	}
+
+	if task.Source.pathFilter != nil {
+		if !task.Source.pathFilter.MatchString(relPath) {
+			return false
+		}
+	} else if task.Source.filter != "" {
 		match, err := filepath.Match(task.Source.filter, name)
 		if err != nil || !match {
 			return false
@@ -157,17 +304,18 @@ func IsMatch(task *ListDirTask, name string, mtime time.Time, size int64) bool {
 
 // return is file, err
 func ParseFilename(fullpath string, params *PathParams, forceDir bool) error {
-	fullpath, filter := filepath.Split(fullpath)
-	if hasMagics(fullpath) {
-		return fmt.Errorf("No support for wildcard directory names")
+	dir, filter := filepath.Split(fullpath)
+	if hasMagics(dir) || strings.Contains(filter, "**") {
+		// list from the longest literal dir, the rest of the path is a pattern
+		return parsePathPattern(filepath.ToSlash(fullpath), params)
 	}
-	params.Path = fullpath
+	params.Path = dir
 	if filter == "" || hasMagics(filter) {
 		params.filter = filter
 		return nil
 	}
 
-	params.Path = fullpath + filter
+	params.Path = dir + filter
 	if forceDir && !endWithSlash(params.Path) {
 		params.Path += "/"
 	}
@@ -175,6 +323,76 @@ func ParseFilename(fullpath string, params *PathParams, forceDir bool) error {
 	return nil
 }
 
+func parsePathPattern(fullpath string, params *PathParams) error {
+	parts := strings.Split(fullpath, "/")
+	i := 0
+	for !hasMagics(parts[i]) {
+		i++
+	}
+	params.Path = strings.Join(parts[:i], "/")
+	if i > 0 {
+		params.Path += "/"
+	}
+	params.filter = strings.Join(parts[i:], "/")
+
+	expr, err := globToRegexp("/" + params.filter)
+	if err == nil {
+		params.pathFilter, err = regexp.Compile(expr)
+	}
+	if err != nil {
+		return fmt.Errorf("bad path pattern %s, %v", params.filter, err)
+	}
+	return nil
+}
+
+// matchDir returns false if no file below a directory (relative to the listed
+// dir) can match the path pattern
+func (p *PathParams) matchDir(relDir string) bool {
+	if p.pathFilter == nil || relDir == "" {
+		return true
+	}
+	patterns := strings.Split(p.filter, "/")
+	for i, dir := range strings.Split(relDir, "/") {
+		if i < len(patterns) && strings.Contains(patterns[i], "**") {
+			return true
+		}
+		if i >= len(patterns)-1 {
+			// the last pattern is the file name
+			return false
+		}
+		if match, _ := path.Match(patterns[i], dir); !match {
+			return false
+		}
+	}
+	return true
+}
+
+// IsRecursive returns true if the listing goes into sub directories, with the
+// Recursive option or a path pattern with directory components, unless MaxDepth
+// limits it to the listed directory
+func (t *ListDirTask) IsRecursive() bool {
+	return (t.Recursive || t.Source.pathFilter != nil) && t.MaxDepth != 1
+}
+
+// matchDir returns false if a directory (relative to the listed dir) is excluded
+// by the filter, is below MaxDepth or cannot contain files matching the path pattern
+func (t *ListDirTask) matchDir(relDir string) bool {
+	relDir = strings.Trim(relDir, "/")
+	if t.MaxDepth > 0 && pathDepth(relDir) >= t.MaxDepth {
+		return false
+	}
+	return t.Filter.MatchDir(relDir) && t.Source.matchDir(relDir)
+}
+
+// pathDepth returns the number of components of a relative path
+func pathDepth(relPath string) int {
+	relPath = strings.Trim(relPath, "/")
+	if relPath == "" {
+		return 0
+	}
+	return strings.Count(relPath, "/") + 1
+}
+
 func hasMagics(text string) bool {
 	for _, c := range text {
 		if c == '*' || c == '?' || c == '[' {
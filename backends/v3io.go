@@ -2,14 +2,21 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/nuclio/logger"
 	"github.com/pkg/errors"
 	v3io "github.com/v3io/v3io-go/pkg/dataplane"
 	v3iohttp "github.com/v3io/v3io-go/pkg/dataplane/http"
+	v3ioerrors "github.com/v3io/v3io-go/pkg/errors"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +27,18 @@ const (
 	V3ioSessionKeyEnvironmentVariable = "V3IO_ACCESS_KEY"
 )
 
+// V3ioChunkSize is the max amount of data buffered by the v3io writer before it
+// is written (appended) to the object, and the range size used by the reader
+var V3ioChunkSize = 4 * 1024 * 1024
+
+// V3ioReadAhead is the number of chunks the v3io reader prefetches in the
+// background, 0 fetches each chunk on demand
+var V3ioReadAhead = 2
+
+// V3ioStatWorkers is the number of concurrent item requests used to read the
+// original mtime and mode of the listed objects (with ListDirTask.WithMeta)
+var V3ioStatWorkers = 16
+
 type V3ioClientOpts struct {
 	WebApiEndpoint string `json:"webApiEndpoint"`
 	Container      string `json:"container"`
@@ -31,11 +50,13 @@ type V3ioClientOpts struct {
 }
 
 type V3ioClient struct {
-	params    *PathParams
-	container v3io.Container
-	logger    logger.Logger
-	task      *ListDirTask
-	path      string
+	params     *PathParams
+	container  v3io.Container
+	logger     logger.Logger
+	task       *ListDirTask
+	path       string
+	httpClient *http.Client
+	authToken  string
 }
 
 func NewV3ioClient(logger logger.Logger, params *PathParams) (FSClient, error) {
@@ -64,24 +85,123 @@ func NewV3ioClient(logger logger.Logger, params *PathParams) (FSClient, error) {
 		return nil, errors.Wrap(err, "Failed to initialize a data container.")
 	}
 
-	newClient := V3ioClient{params: params, container: newContainer, logger: logger}
+	newClient := V3ioClient{params: params, container: newContainer, logger: logger, httpClient: &http.Client{}}
+	if params.UserKey != "" && params.Secret != "" && params.Token == "" {
+		newClient.authToken = v3iohttp.GenerateAuthenticationToken(params.UserKey, params.Secret)
+	}
 	return &newClient, err
 }
 
-func (c *V3ioClient) ListDir(fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
+// parseV3ioURL parses v3io(s)://<API_URL>/<container>/path URLs
+func parseV3ioURL(u *url.URL, params *PathParams) error {
+	params.Secure = params.Kind == "v3ios"
+	params.Kind = "v3io"
+	params.Endpoint = u.Host
+	params.Bucket, params.Path = SplitPath(params.Path)
+	return nil
+}
+
+func (c *V3ioClient) ListDir(ctx context.Context, fileChan chan *FileDetails, task *ListDirTask, summary *ListSummary) error {
 	//bucket, keyPrefix := splitPath(searcher.Path)
 	defer close(fileChan)
 	c.task = task
 	c.path = c.params.Path
 
-	return c.getDir(c.path, fileChan, summary)
+	if task.WithMeta {
+		return c.listWithMeta(ctx, fileChan, summary)
+	}
+	return c.getDir(ctx, c.path, task, fileChan, summary)
 }
 
-func (c *V3ioClient) getDir(path string, fileChan chan *FileDetails, summary *ListSummary) error {
+// listWithMeta lists the objects with the original mtime and mode stored in
+// their attributes, the time filter is applied to the original mtime
+func (c *V3ioClient) listWithMeta(ctx context.Context, fileChan chan *FileDetails, summary *ListSummary) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lock sync.Mutex
+	var listErr error
+	fail := func(err error) {
+		lock.Lock()
+		if listErr == nil {
+			listErr = err
+		}
+		lock.Unlock()
+		cancel()
+	}
+
+	listed := make(chan *FileDetails)
+	var wg sync.WaitGroup
+	for i := 0; i < V3ioStatWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileDetails := range listed {
+				if ctx.Err() != nil {
+					continue
+				}
+				var meta *FileMeta
+				err := Retry.Do(ctx, c.logger, func() error {
+					var err error
+					meta, err = c.attributes(fileDetails.Key)
+					return err
+				})
+				if IsNotFound(err) {
+					// deleted since it was listed
+					c.logger.DebugWith("listed object not found", "key", fileDetails.Key)
+					continue
+				} else if err != nil {
+					fail(err)
+					continue
+				}
+				if !meta.Mtime.IsZero() {
+					fileDetails.Mtime = meta.Mtime
+				}
+				fileDetails.Mode = meta.Mode
+				if !IsMatch(c.task, relativeFileKey(c.path, fileDetails.Key), fileDetails.Mtime, fileDetails.Size) {
+					continue
+				}
+
+				c.logger.DebugWith("List dir:", "key", fileDetails.Key,
+					"modified", fileDetails.Mtime, "size", fileDetails.Size, "mode", fileDetails.Mode)
+				lock.Lock()
+				summary.TotalBytes += fileDetails.Size
+				summary.TotalFiles += 1
+				lock.Unlock()
+				select {
+				case fileChan <- fileDetails:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	// the other filters are checked before the item requests
+	untimed := *c.task
+	untimed.Since, untimed.Until = time.Time{}, time.Time{}
+	err := c.getDir(ctx, c.path, &untimed, listed, &ListSummary{})
+	close(listed)
+	wg.Wait()
+
+	if listErr != nil {
+		return listErr
+	}
+	return err
+}
+
+func (c *V3ioClient) getDir(ctx context.Context, path string, task *ListDirTask, fileChan chan *FileDetails, summary *ListSummary) error {
 
 	req := v3io.GetContainerContentsInput{Path: path}
 	for {
-		resp, err := c.container.GetContainerContentsSync(&req)
+		var resp *v3io.Response
+		err := Retry.Do(ctx, c.logger, func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var err error
+			resp, err = c.container.GetContainerContentsSync(&req)
+			return err
+		})
 		if err != nil {
 			c.logger.ErrorWith("ListBucket failed", "endpoint", c.params.Endpoint, "container",
 				c.params.Bucket, "path", path)
@@ -103,27 +223,29 @@ func (c *V3ioClient) getDir(path string, fileChan chan *FileDetails, summary *Li
 			if obj.Size != nil {
 				size = int64(*obj.Size)
 			}
-			_, name := filepath.Split(obj.Key)
-
-			if !IsMatch(c.task, name, t, size) {
+			if !IsMatch(task, relativeFileKey(c.path, obj.Key), t, size) {
 				continue
 			}
 
 			c.logger.DebugWith("List dir:", "key", obj.Key, "modified", obj.LastModified, "size", obj.Size)
 			fileDetails := &FileDetails{
-				Key: obj.Key, Size: size, //Mtime: obj.LastModified,
+				Key: obj.Key, Size: size, Mtime: t,
 			}
 
 			summary.TotalBytes += size
 			summary.TotalFiles += 1
-			fileChan <- fileDetails
+			select {
+			case fileChan <- fileDetails:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
-		if c.task.Recursive {
+		if task.IsRecursive() {
 			for _, val := range result.CommonPrefixes {
 				_, name := filepath.Split(val.Prefix[0 : len(val.Prefix)-1])
-				if c.task.Hidden || !strings.HasPrefix(name, ".") {
-					err = c.getDir(val.Prefix, fileChan, summary)
+				if (task.Hidden || !strings.HasPrefix(name, ".")) && task.matchDir(relativeKey(c.path, val.Prefix)) {
+					err = c.getDir(ctx, val.Prefix, task, fileChan, summary)
 					if err != nil {
 						return err
 					}
@@ -139,52 +261,349 @@ func (c *V3ioClient) getDir(path string, fileChan chan *FileDetails, summary *Li
 	return nil
 }
 
-func (c *V3ioClient) Reader(path string) (FSReader, error) {
-	resp, err := c.container.GetObjectSync(&v3io.GetObjectInput{Path: path})
-	if err != nil {
-		return nil, fmt.Errorf("Error in GetObject operation (%v)", err)
+func (c *V3ioClient) Reader(ctx context.Context, path string) (FSReader, error) {
+	r := &v3ioReader{ctx: ctx, client: c, path: path, done: make(chan struct{})}
+	chunk := r.fetch()
+	if chunk.err != nil {
+		return nil, errors.Wrap(chunk.err, "Error in GetObject operation")
+	}
+	r.buf = chunk.data
+
+	if !r.last && V3ioReadAhead > 0 {
+		r.chunks = make(chan *v3ioChunk, V3ioReadAhead)
+		go r.readAhead()
 	}
+	return r, nil
+}
 
-	return &v3ioReader{reader: bytes.NewReader(resp.Body())}, nil
+type v3ioChunk struct {
+	data []byte
+	err  error
 }
 
+// v3ioReader fetches the object in V3ioChunkSize ranges, a short (or empty)
+// range marks the end of the object
 type v3ioReader struct {
-	reader io.Reader
+	ctx    context.Context
+	client *V3ioClient
+	path   string
+	offset int64
+	last   bool
+	buf    []byte
+	err    error
+	chunks chan *v3ioChunk
+	done   chan struct{}
+	closed bool
+}
+
+func (r *v3ioReader) fetch() *v3ioChunk {
+	headers := map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+int64(V3ioChunkSize)-1)}
+
+	var data []byte
+	err := Retry.Do(r.ctx, r.client.logger, func() error {
+		resp, err := r.client.objectRequest(r.ctx, http.MethodGet, r.path, headers, nil)
+		if err != nil {
+			if e, ok := err.(v3ioerrors.ErrorWithStatusCode); ok && e.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+				data = nil
+				return nil
+			}
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, int64(V3ioChunkSize)))
+		return err
+	})
+	if err != nil {
+		return &v3ioChunk{err: errors.Wrapf(err, "failed to read %s at offset %d", r.path, r.offset)}
+	}
+
+	r.offset += int64(len(data))
+	r.last = len(data) < V3ioChunkSize
+	return &v3ioChunk{data: data}
+}
+
+func (r *v3ioReader) readAhead() {
+	defer close(r.chunks)
+	for !r.last {
+		chunk := r.fetch()
+		select {
+		case r.chunks <- chunk:
+		case <-r.done:
+			return
+		}
+		if chunk.err != nil {
+			return
+		}
+	}
 }
 
 func (r *v3ioReader) Read(p []byte) (n int, err error) {
-	return r.reader.Read(p)
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		var chunk *v3ioChunk
+		if r.chunks != nil {
+			var more bool
+			if chunk, more = <-r.chunks; !more {
+				return 0, io.EOF
+			}
+		} else {
+			if r.last {
+				return 0, io.EOF
+			}
+			chunk = r.fetch()
+		}
+		r.buf, r.err = chunk.data, chunk.err
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
 }
 
 func (r *v3ioReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	r.buf = nil
 	return nil
 }
 
 func (r *v3ioReader) Stat() (*FileMeta, error) {
-	// TBD return Mtime, ..
+	return r.client.attributes(r.path)
+}
+
+// Stat returns the object size and mtime, or the original mtime and mode if
+// they were stored, and the stored checksum
+func (c *V3ioClient) Stat(ctx context.Context, path string) (*FileDetails, error) {
+	item, err := c.getItem(path, "__size", "__mtime_secs", "__mtime_nsecs", OriginalMtimeKey, OriginalModeKey, ChecksumKey)
+	if err != nil {
+		return nil, err
+	}
+	size, _ := item.GetFieldInt("__size")
+	secs, _ := item.GetFieldInt("__mtime_secs")
+	nsecs, _ := item.GetFieldInt("__mtime_nsecs")
+	details := FileDetails{Key: path, Size: int64(size), Mtime: time.Unix(int64(secs), int64(nsecs))}
+
+	meta := itemMeta(item)
+	if !meta.Mtime.IsZero() {
+		details.Mtime = meta.Mtime
+	}
+	details.Mode = meta.Mode
+	details.Checksum = meta.Checksum
+	return &details, nil
+}
+
+// attributes returns the original mtime, mode and checksum stored with the
+// object, fields which are not set are left empty
+func (c *V3ioClient) attributes(path string) (*FileMeta, error) {
+	item, err := c.getItem(path, OriginalMtimeKey, OriginalModeKey, ChecksumKey)
+	if err != nil {
+		return nil, err
+	}
+	return itemMeta(item), nil
+}
+
+func (c *V3ioClient) getItem(path string, names ...string) (v3io.Item, error) {
+	resp, err := c.container.GetItemSync(&v3io.GetItemInput{Path: path, AttributeNames: names})
+	if err != nil {
+		if isV3ioNotFound(err) {
+			return nil, errors.Wrap(ErrNotFound, path)
+		}
+		return nil, errors.Wrapf(err, "failed to get %s attributes", path)
+	}
+	defer resp.Release()
+	return resp.Output.(*v3io.GetItemOutput).Item, nil
+}
+
+func itemMeta(item v3io.Item) *FileMeta {
 	meta := FileMeta{}
-	return &meta, nil
+	if mtime, err := item.GetFieldString(OriginalMtimeKey); err == nil {
+		if t, err := time.Parse(time.RFC3339, mtime); err == nil {
+			meta.Mtime = t
+		}
+	}
+	if mode, err := item.GetFieldInt(OriginalModeKey); err == nil {
+		meta.Mode = uint32(mode)
+	}
+	if checksum, err := item.GetFieldString(ChecksumKey); err == nil {
+		meta.Checksum = checksum
+	}
+	return &meta
+}
+
+func isV3ioNotFound(err error) bool {
+	e, ok := errors.Cause(err).(v3ioerrors.ErrorWithStatusCode)
+	return ok && e.StatusCode() == http.StatusNotFound
+}
+
+func (c *V3ioClient) Delete(ctx context.Context, path string) error {
+	err := c.container.DeleteObjectSync(&v3io.DeleteObjectInput{Path: path})
+	if isV3ioNotFound(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	return err
+}
+
+// Mkdir is a no-op, directories are created with the objects
+func (c *V3ioClient) Mkdir(ctx context.Context, path string) error {
+	return nil
 }
 
-func (c *V3ioClient) Writer(path string, opts *FileMeta) (io.WriteCloser, error) {
-	return &v3ioWriter{path: path, container: c.container, opts: opts}, nil
+func (c *V3ioClient) Rename(ctx context.Context, oldPath, newPath string) error {
+	return ErrNotSupported
 }
 
+func (c *V3ioClient) Writer(ctx context.Context, path string, opts *FileMeta) (io.WriteCloser, error) {
+	return &v3ioWriter{ctx: ctx, path: path, client: c, opts: opts}, nil
+}
+
+// v3ioWriter buffers up to V3ioChunkSize bytes, the first chunk creates the
+// object and the following chunks are appended to it
 type v3ioWriter struct {
-	path      string
-	buf       []byte
-	opts      *FileMeta
-	container v3io.Container
+	ctx      context.Context
+	path     string
+	buf      []byte
+	offset   int64
+	opts     *FileMeta
+	client   *V3ioClient
+	aborted  bool
+	checksum string
 }
 
 func (w *v3ioWriter) Write(p []byte) (n int, err error) {
-	w.buf = append(w.buf, p...)
-	return len(p), nil
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, V3ioChunkSize)
+		}
+		chunk := V3ioChunkSize - len(w.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		w.buf = append(w.buf, p[:chunk]...)
+		n += chunk
+		p = p[chunk:]
+
+		if len(w.buf) >= V3ioChunkSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *v3ioWriter) flush() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	if w.offset == 0 {
+		err = w.client.container.PutObjectSync(&v3io.PutObjectInput{Path: w.path, Body: w.buf})
+	} else {
+		var resp *http.Response
+		resp, err = w.client.objectRequest(w.ctx, http.MethodPut, w.path, map[string]string{"Range": "-1"}, w.buf)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s at offset %d", w.path, w.offset)
+	}
+
+	w.offset += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
 }
 
 func (w *v3ioWriter) Close() error {
-	// TBD write time, mode, kv metadata
-	return w.container.PutObjectSync(&v3io.PutObjectInput{Path: w.path, Body: w.buf})
+	if w.aborted {
+		return fmt.Errorf("write to %s was aborted", w.path)
+	}
+	if len(w.buf) > 0 || w.offset == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.buf = nil
+
+	if attrs := v3ioAttributes(w.opts, w.checksum); len(attrs) > 0 {
+		err := w.client.container.UpdateItemSync(&v3io.UpdateItemInput{Path: w.path, Attributes: attrs})
+		if err != nil {
+			return errors.Wrapf(err, "failed to set %s attributes", w.path)
+		}
+	}
+	return nil
+}
+
+// v3ioAttributes returns the object attributes for the file metadata and checksum
+func v3ioAttributes(opts *FileMeta, checksum string) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	if opts != nil && !opts.Mtime.IsZero() {
+		attrs[OriginalMtimeKey] = opts.Mtime.Format(time.RFC3339)
+		attrs[OriginalModeKey] = int(opts.Mode)
+	}
+	if checksum != "" {
+		attrs[ChecksumKey] = checksum
+	}
+	return attrs
+}
+
+// SetChecksum stores the checksum as an object attribute
+func (w *v3ioWriter) SetChecksum(checksum string) {
+	w.checksum = checksum
+}
+
+// Abort drops the buffered data and deletes the partially written object
+func (w *v3ioWriter) Abort() error {
+	w.aborted = true
+	w.buf = nil
+	if w.offset == 0 {
+		return nil
+	}
+	return w.client.container.DeleteObjectSync(&v3io.DeleteObjectInput{Path: w.path})
+}
+
+// objectRequest sends a raw object request to the web API, used for appends and
+// ranged reads which the v3io-go object calls do not support
+func (c *V3ioClient) objectRequest(ctx context.Context, method, objPath string, headers map[string]string, body []byte) (*http.Response, error) {
+	uri, err := url.Parse(c.params.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse endpoint %s", c.params.Endpoint)
+	}
+	uri.Path = path.Join("/", c.params.Bucket, objPath)
+
+	req, err := http.NewRequest(method, uri.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.params.Token != "" {
+		req.Header.Set("X-v3io-session-key", c.params.Token)
+	} else if c.authToken != "" {
+		req.Header.Set("Authorization", c.authToken)
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, v3ioerrors.NewErrorWithStatusCode(
+			fmt.Errorf("%s %s returned status %d: %s", method, objPath, resp.StatusCode, msg), resp.StatusCode)
+	}
+	return resp, nil
 }
 
 func CreateContainer(logger logger.Logger, addr, cont string, config *v3io.NewSessionInput, workers int) (v3io.Container, error) {
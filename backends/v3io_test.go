@@ -0,0 +1,403 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nuclio/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeV3io serves the listing, object and item requests of the v3io web API
+// for the objects of a single container, the deleted objects are listed but
+// not found. the object PUT sizes are recorded, and the reads and appends
+// starting at failOffset (if not 0) fail. the item requests of the retryItems
+// fail once with a retryable error, and the concurrent item requests are counted
+type fakeV3io struct {
+	lock        sync.Mutex
+	objects     map[string][]byte
+	attrs       map[string]map[string]map[string]interface{}
+	deleted     map[string]bool
+	puts        []int
+	failOffset  int
+	retryItems  map[string]bool
+	inflight    int
+	maxInflight int
+}
+
+func newFakeV3io() *fakeV3io {
+	return &fakeV3io{objects: map[string][]byte{}, attrs: map[string]map[string]map[string]interface{}{},
+		deleted: map[string]bool{}, retryItems: map[string]bool{}}
+}
+
+func (f *fakeV3io) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-v3io-function") == "GetItem" {
+		// a short delay (without holding the lock) so concurrent requests overlap
+		f.lock.Lock()
+		f.inflight++
+		if f.inflight > f.maxInflight {
+			f.maxInflight = f.inflight
+		}
+		f.lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		defer func() {
+			f.lock.Lock()
+			f.inflight--
+			f.lock.Unlock()
+		}()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/container/")
+	body, _ := ioutil.ReadAll(r.Body)
+	data, exists := f.objects[key]
+
+	switch {
+	case r.Header.Get("X-v3io-function") == "PutItem":
+		item := struct {
+			Item map[string]map[string]interface{}
+		}{}
+		json.Unmarshal(body, &item)
+		if f.attrs[key] == nil {
+			f.attrs[key] = map[string]map[string]interface{}{}
+		}
+		for name, value := range item.Item {
+			f.attrs[key][name] = value
+		}
+	case r.Header.Get("X-v3io-function") == "GetItem":
+		if f.retryItems[key] {
+			delete(f.retryItems, key)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		item := map[string]map[string]interface{}{
+			"__size": {"N": strconv.Itoa(len(data))}, "__mtime_secs": {"N": "1577934245"}, "__mtime_nsecs": {"N": "0"}}
+		for name, value := range f.attrs[key] {
+			item[name] = value
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case r.Method == http.MethodPut && r.Header.Get("Range") == "-1":
+		if f.failOffset > 0 && len(data) == f.failOffset {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.puts = append(f.puts, len(body))
+		f.objects[key] = append(data, body...)
+	case r.Method == http.MethodPut:
+		f.puts = append(f.puts, len(body))
+		f.objects[key] = body
+	case r.Method == http.MethodGet && r.Header.Get("Range") != "":
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+		} else if f.failOffset > 0 && start == f.failOffset {
+			w.WriteHeader(http.StatusForbidden)
+		} else if start >= len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		} else {
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Write(data[start : end+1])
+		}
+	case r.Method == http.MethodGet:
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.attrs, key)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// list writes the objects and the sub directories of a prefix
+func (f *fakeV3io) list(w http.ResponseWriter, prefix string) {
+	fmt.Fprint(w, `<ListBucketResult><Name>container</Name><IsTruncated>false</IsTruncated>`)
+	dirs := map[string]bool{}
+	for _, keys := range []map[string]bool{f.objectKeys(), f.deleted} {
+		for key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+				dirs[key[:len(prefix)+i+1]] = true
+				continue
+			}
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>`,
+				key, len(f.objects[key]), time.Now().UTC().Format(time.RFC3339))
+		}
+	}
+	for dir := range dirs {
+		fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, dir)
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func (f *fakeV3io) objectKeys() map[string]bool {
+	keys := map[string]bool{}
+	for key := range f.objects {
+		keys[key] = true
+	}
+	return keys
+}
+
+func newTestV3ioClient(t *testing.T, endpoint string) *V3ioClient {
+	logger, _ := nucliozap.NewNuclioZapCmd("test", nucliozap.ErrorLevel)
+	params := PathParams{Kind: "v3io", Endpoint: endpoint, Bucket: "container", Token: "key"}
+	client, err := NewV3ioClient(logger, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*V3ioClient)
+}
+
+func TestV3ioChunkedWrite(t *testing.T) {
+	defer func(size int) { V3ioChunkSize = size }(V3ioChunkSize)
+	V3ioChunkSize = 10
+
+	fake := newFakeV3io()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+
+	// the first chunk creates the object and the rest are appended, an exact
+	// multiple of the chunk size ends without an empty append and an empty
+	// file is still created
+	for _, test := range []struct {
+		size int
+		puts []int
+	}{{25, []int{10, 10, 5}}, {20, []int{10, 10}}, {3, []int{3}}, {0, []int{0}}} {
+		fake.puts = nil
+		content := bytes.Repeat([]byte("0123456789abcdef"), 2)[:test.size]
+		w, err := client.Writer(context.Background(), "dir/obj.bin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// odd sized writes which cross the chunk boundaries
+		for data := content; len(data) > 0; {
+			n := 7
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(fake.puts) != fmt.Sprint(test.puts) {
+			t.Fatalf("size %d: expected puts %v, got %v", test.size, test.puts, fake.puts)
+		}
+		if !bytes.Equal(fake.objects["dir/obj.bin"], content) {
+			t.Fatalf("size %d: unexpected content %q", test.size, fake.objects["dir/obj.bin"])
+		}
+	}
+}
+
+func TestV3ioWriteError(t *testing.T) {
+	defer func(size int) { V3ioChunkSize = size }(V3ioChunkSize)
+	V3ioChunkSize = 10
+
+	fake := newFakeV3io()
+	fake.failOffset = 20
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+
+	w, err := client.Writer(context.Background(), "obj.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := w.Write(make([]byte, 35))
+	if err == nil || !strings.Contains(err.Error(), "at offset 20") {
+		t.Fatalf("expected a write error at offset 20, got %v", err)
+	}
+	if n != 30 {
+		t.Fatalf("expected 30 bytes to be accepted before the error, got %d", n)
+	}
+
+	// the partially written object is deleted
+	if err := w.(FSAborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := fake.objects["obj.bin"]; exists {
+		t.Fatalf("expected the aborted object to be deleted")
+	}
+}
+
+func TestV3ioRangedRead(t *testing.T) {
+	defer func(size, readAhead int) { V3ioChunkSize, V3ioReadAhead = size, readAhead }(V3ioChunkSize, V3ioReadAhead)
+	V3ioChunkSize = 10
+
+	fake := newFakeV3io()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+
+	// an exact multiple of the chunk size (and an empty object) ends with an
+	// out of range (416) request
+	for _, readAhead := range []int{0, 2} {
+		V3ioReadAhead = readAhead
+		for _, size := range []int{25, 20, 3, 0} {
+			content := bytes.Repeat([]byte("0123456789abcdef"), 2)[:size]
+			fake.objects["obj.bin"] = content
+			r, err := client.Reader(context.Background(), "obj.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read ahead %d, size %d: %v", readAhead, size, err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Fatalf("read ahead %d, size %d: unexpected content %q", readAhead, size, data)
+			}
+			r.Close()
+		}
+	}
+
+	if _, err := client.Reader(context.Background(), "missing.bin"); err == nil {
+		t.Fatalf("expected an error for a missing object")
+	}
+}
+
+func TestV3ioReadError(t *testing.T) {
+	defer func(size, readAhead int) { V3ioChunkSize, V3ioReadAhead = size, readAhead }(V3ioChunkSize, V3ioReadAhead)
+	V3ioChunkSize = 10
+
+	fake := newFakeV3io()
+	fake.objects["obj.bin"] = make([]byte, 35)
+	fake.failOffset = 20
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+
+	for _, readAhead := range []int{0, 2} {
+		V3ioReadAhead = readAhead
+		r, err := client.Reader(context.Background(), "obj.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err == nil || !strings.Contains(err.Error(), "at offset 20") {
+			t.Fatalf("read ahead %d: expected a read error at offset 20, got %v", readAhead, err)
+		}
+		if len(data) != 20 {
+			t.Fatalf("read ahead %d: expected the first 20 bytes before the error, got %d", readAhead, len(data))
+		}
+		r.Close()
+	}
+}
+
+func TestV3ioAttributes(t *testing.T) {
+	fake := newFakeV3io()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+
+	// the original mtime and mode (and the checksum) are stored as attributes
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	w, err := client.Writer(context.Background(), "dir/a.csv", &FileMeta{Mtime: mtime, Mode: 0640})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(FSChecksummer).SetChecksum("md5:abc")
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := client.Stat(context.Background(), "dir/a.csv")
+	if err != nil || !f.Mtime.Equal(mtime) || f.Mode != 0640 || f.Size != 3 || f.Checksum != "md5:abc" {
+		t.Fatalf("unexpected stat %+v (%v)", f, err)
+	}
+	r, err := client.Reader(context.Background(), "dir/a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := r.Stat()
+	r.Close()
+	if err != nil || !meta.Mtime.Equal(mtime) || meta.Mode != 0640 || meta.Checksum != "md5:abc" {
+		t.Fatalf("unexpected reader stat %+v (%v)", meta, err)
+	}
+	if _, err := client.Stat(context.Background(), "dir/missing.csv"); !IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestV3ioListWithMeta(t *testing.T) {
+	defer func(workers int, retry *RetryPolicy) { V3ioStatWorkers, Retry = workers, retry }(V3ioStatWorkers, Retry)
+	V3ioStatWorkers = 4
+	Retry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeV3io()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("dir/sub/%02d.csv", i)
+		fake.objects[key] = []byte("abc")
+		fake.attrs[key] = map[string]map[string]interface{}{
+			OriginalMtimeKey: {"S": mtime.Format(time.RFC3339)}, OriginalModeKey: {"N": "416"}}
+	}
+	fake.objects["dir/new.csv"] = []byte("abcd")
+	fake.deleted["dir/gone.csv"] = true
+	fake.retryItems["dir/sub/03.csv"] = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestV3ioClient(t, server.URL)
+	client.params.Path = "dir/"
+
+	// the time filter applies to the original mtime, new.csv has none and an
+	// object deleted after it was listed is skipped
+	task := ListDirTask{Source: client.params, Recursive: true, WithMeta: true, Since: mtime.Add(time.Hour)}
+	fileChan := make(chan *FileDetails, 100)
+	summary := ListSummary{}
+	if err := client.ListDir(context.Background(), fileChan, &task, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalFiles != 1 || summary.TotalBytes != 4 {
+		t.Fatalf("expected only new.csv to be listed, got %+v", summary)
+	}
+	if f := <-fileChan; f.Key != "dir/new.csv" {
+		t.Fatalf("unexpected file %+v", f)
+	}
+
+	task.Since = time.Time{}
+	fileChan = make(chan *FileDetails, 100)
+	summary = ListSummary{}
+	if err := client.ListDir(context.Background(), fileChan, &task, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalFiles != 21 {
+		t.Fatalf("expected 21 files, got %+v", summary)
+	}
+	for f := range fileChan {
+		if f.Key != "dir/new.csv" && (!f.Mtime.Equal(mtime) || f.Mode != 0640) {
+			t.Fatalf("expected the original mtime and mode, got %+v", f)
+		}
+	}
+	if fake.maxInflight < 2 || fake.maxInflight > 4 {
+		t.Fatalf("expected up to 4 concurrent item requests, got %d", fake.maxInflight)
+	}
+	if len(fake.retryItems) != 0 {
+		t.Fatalf("expected the failed item request to be retried")
+	}
+}
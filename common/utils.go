@@ -65,26 +65,8 @@ func UrlParse(fullpath string, forceDir bool) (*backends.PathParams, error) {
 		pathParams.Secret = password
 	}
 
-	switch pathParams.Kind {
-	case "s3":
-		// TODO: region url
-		pathParams.Bucket = u.Host
-	case "v3io":
-		pathParams.Kind = "v3io"
-		pathParams.Endpoint = u.Host
-		pathParams.Bucket, pathParams.Path = backends.SplitPath(pathParams.Path)
-	case "v3ios":
-		pathParams.Secure = true
-		pathParams.Kind = "v3io"
-		pathParams.Endpoint = u.Host
-		pathParams.Bucket, pathParams.Path = backends.SplitPath(pathParams.Path)
-	case "http", "https":
-		pathParams.Secure = pathParams.Kind == "https"
-		pathParams.Kind = "s3"
-		pathParams.Endpoint = u.Host
-		pathParams.Bucket, pathParams.Path = backends.SplitPath(pathParams.Path)
-	default:
-		pathParams.Endpoint = u.Host
+	if err := backends.ParseURL(u, &pathParams); err != nil {
+		return nil, err
 	}
 
 	return &pathParams, nil
@@ -121,7 +103,7 @@ func String2Time(timeString string) (time.Time, error) {
 			} else if sign == "+" {
 				return now.Add(d), nil
 			} else {
-				return time.Time{}, errors.Wrapf(err, "Unsupported time format:", timeString)
+				return time.Time{}, errors.Errorf("Unsupported time format: %s", timeString)
 			}
 		} else {
 			return now, nil
@@ -0,0 +1,138 @@
+package operators
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/v3io/xcp/backends"
+	"os"
+	"sync"
+	"time"
+)
+
+// CheckpointEntry is a journal line, a completed file or the state of a
+// partial upload of the file, the lines of an upload have a single part which
+// is added to the parts of the previous lines
+type CheckpointEntry struct {
+	Key    string                `json:"key"`
+	Size   int64                 `json:"size"`
+	Mtime  time.Time             `json:"mtime"`
+	ETag   string                `json:"etag,omitempty"`
+	Upload *backends.UploadState `json:"upload,omitempty"`
+}
+
+// Checkpoint is an append only journal (json lines) of the files completed by
+// a copy, used to skip completed files and resume partial uploads on a re-run
+type Checkpoint struct {
+	file    *os.File
+	lock    sync.Mutex
+	entries map[string]*CheckpointEntry
+}
+
+// OpenCheckpoint loads the journal entries from path (if it exists) and opens
+// it for appending
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	checkpoint := Checkpoint{entries: map[string]*CheckpointEntry{}}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			entry := CheckpointEntry{}
+			// a partially written last line is ignored
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				checkpoint.add(&entry)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint %s, %v", path, err)
+		}
+	}
+
+	var err error
+	checkpoint.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint %s, %v", path, err)
+	}
+	return &checkpoint, nil
+}
+
+func (c *Checkpoint) entry(f *backends.FileDetails) *CheckpointEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[f.Key]
+	if !ok || entry.Size != f.Size || !entry.Mtime.Equal(f.Mtime) {
+		return nil
+	}
+	return entry
+}
+
+// StaleUpload returns the partial upload of a file which changed since the
+// upload was started (nil if none), it cannot be resumed
+func (c *Checkpoint) StaleUpload(f *backends.FileDetails) *backends.UploadState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[f.Key]
+	if !ok || entry.Upload == nil || (entry.Size == f.Size && entry.Mtime.Equal(f.Mtime)) {
+		return nil
+	}
+	return entry.Upload
+}
+
+// IsDone returns true if the (unchanged) file was completed by a previous run
+func (c *Checkpoint) IsDone(f *backends.FileDetails) bool {
+	entry := c.entry(f)
+	return entry != nil && entry.Upload == nil
+}
+
+// UploadState returns the partial upload state of the (unchanged) file
+func (c *Checkpoint) UploadState(f *backends.FileDetails) *backends.UploadState {
+	if entry := c.entry(f); entry != nil {
+		return entry.Upload
+	}
+	return nil
+}
+
+// Done records a completed file with its destination etag (if known)
+func (c *Checkpoint) Done(f *backends.FileDetails, etag string) error {
+	return c.append(&CheckpointEntry{Key: f.Key, Size: f.Size, Mtime: f.Mtime, ETag: etag})
+}
+
+// SaveUpload records a started upload or a completed part of the upload
+func (c *Checkpoint) SaveUpload(f *backends.FileDetails, state *backends.UploadState) error {
+	return c.append(&CheckpointEntry{Key: f.Key, Size: f.Size, Mtime: f.Mtime, Upload: state})
+}
+
+func (c *Checkpoint) append(entry *CheckpointEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(entry)
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// add sets the entry of a file, the parts of an upload are added to the parts
+// of the same upload, called with the lock held (or before it is shared)
+func (c *Checkpoint) add(entry *CheckpointEntry) {
+	prev, ok := c.entries[entry.Key]
+	if ok && entry.Upload != nil && prev.Upload != nil && prev.Upload.UploadID == entry.Upload.UploadID &&
+		prev.Size == entry.Size && prev.Mtime.Equal(entry.Mtime) {
+		prev.Upload.Parts = append(prev.Upload.Parts, entry.Upload.Parts...)
+		return
+	}
+	c.entries[entry.Key] = entry
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,96 @@
+package operators
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/v3io/xcp/backends"
+	"path"
+	"strings"
+)
+
+// policies for destination files which already exist (CopyOptions.OnConflict)
+const (
+	ConflictOverwrite        = "overwrite"
+	ConflictSkip             = "skip"
+	ConflictSkipIfSameSize   = "skip-if-same-size"
+	ConflictOverwriteIfNewer = "overwrite-if-newer"
+	ConflictRename           = "rename"
+	ConflictFail             = "fail"
+)
+
+// ErrDestinationExists fails a file with the fail conflict policy
+var ErrDestinationExists = errors.New("destination file exists")
+
+// maxRenames limits the suffixes tried by the rename conflict policy
+const maxRenames = 1000
+
+type conflictAction int
+
+const (
+	conflictNone conflictAction = iota
+	conflictOverwrite
+	conflictSkip
+	conflictRename
+)
+
+func validConflictPolicy(policy string) error {
+	switch policy {
+	case "", ConflictOverwrite, ConflictSkip, ConflictSkipIfSameSize, ConflictOverwriteIfNewer, ConflictRename, ConflictFail:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %s use %s", policy, strings.Join([]string{ConflictOverwrite, ConflictSkip,
+		ConflictSkipIfSameSize, ConflictOverwriteIfNewer, ConflictRename, ConflictFail}, ", "))
+}
+
+// resolveConflict checks if the destination file exists and returns the action
+// of the conflict policy, and the target path to write (renamed or not). the
+// default overwrite policy does not check, except in a dry run which reports
+// the overwritten files
+func (c *copier) resolveConflict(ctx context.Context, dst backends.FSClient, f *backends.FileDetails, targetPath string) (string, conflictAction, error) {
+	if (c.onConflict == "" || c.onConflict == ConflictOverwrite) && !c.dryRun {
+		return targetPath, conflictNone, nil
+	}
+	existing, err := dst.Stat(ctx, targetKey(c.target, targetPath))
+	if backends.IsNotFound(err) {
+		return targetPath, conflictNone, nil
+	} else if err != nil {
+		return "", conflictNone, err
+	}
+
+	switch c.onConflict {
+	case ConflictSkip:
+		return targetPath, conflictSkip, nil
+	case ConflictSkipIfSameSize:
+		if existing.Size == f.Size {
+			return targetPath, conflictSkip, nil
+		}
+	case ConflictOverwriteIfNewer:
+		if !f.Mtime.After(existing.Mtime) {
+			return targetPath, conflictSkip, nil
+		}
+	case ConflictRename:
+		renamed, err := c.freeName(ctx, dst, targetPath)
+		return renamed, conflictRename, err
+	case ConflictFail:
+		return "", conflictNone, errors.Wrap(ErrDestinationExists, targetKey(c.target, targetPath))
+	}
+	return targetPath, conflictOverwrite, nil
+}
+
+// freeName returns the first target path with a numeric suffix before the
+// extension (name.1.ext, name.2.ext, ..) which does not exist
+func (c *copier) freeName(ctx context.Context, dst backends.FSClient, targetPath string) (string, error) {
+	ext := path.Ext(targetPath)
+	base := strings.TrimSuffix(targetPath, ext)
+	for i := 1; i <= maxRenames; i++ {
+		renamed := fmt.Sprintf("%s.%d%s", base, i, ext)
+		_, err := dst.Stat(ctx, targetKey(c.target, renamed))
+		if backends.IsNotFound(err) {
+			return renamed, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %s after %d renames", targetPath, maxRenames)
+}
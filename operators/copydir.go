@@ -1,106 +1,545 @@
 package operators
 
 import (
+	"context"
 	"fmt"
 	"github.com/nuclio/logger"
 	"github.com/v3io/xcp/backends"
+	"hash"
 	"io"
+	"io/ioutil"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
-func CopyDir(task *backends.ListDirTask, target *backends.PathParams, logger logger.Logger, workers int) error {
+type CopyOptions struct {
+	// stop on the first failed file, by default the other files are still copied
+	FailFast bool
+	// journal file of the completed files, files completed by a previous run
+	// are skipped and partial uploads are resumed
+	Checkpoint string
+	// checksum algorithm (md5, crc32c or sha256) used to verify the copied
+	// files, the checksum is also stored as destination metadata when supported
+	Verify string
+	// called every ProgressInterval (default 1s) with the progress, and once
+	// more when done, see ProgressToChannel for a channel
+	OnProgress       func(*Progress)
+	ProgressInterval time.Duration
+	// list every copied file in the report manifest
+	Manifest bool
+	// delete every source file once it is copied (and verified), not supported
+	// by SyncDir
+	Move bool
+	// with Move, remove the source directories left empty (local and sftp)
+	PruneEmptyDirs bool
+	// policy for destination files which already exist (Conflict*), by default
+	// they are overwritten without checking, not supported by SyncDir
+	OnConflict string
+	// list and compare the files and report the planned actions, without
+	// writing or deleting any file
+	DryRun bool
+	// copy the files of a list instead of listing the source, a path relative
+	// to the source per line or json lines (FilesFromEntry), "-" reads stdin.
+	// missing files fail, not supported by SyncDir
+	FilesFrom string
+}
+
+// FileError is the failure of a single file (key)
+type FileError struct {
+	Key string
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+type CopyReport struct {
+	// source and target params with the secrets redacted
+	Source    *backends.PathParams `json:"source"`
+	Target    *backends.PathParams `json:"target"`
+	StartTime time.Time            `json:"startTime"`
+	EndTime   time.Time            `json:"endTime"`
+	// listed files (after filtering)
+	TotalFiles  int   `json:"totalFiles"`
+	TotalBytes  int64 `json:"totalBytes"`
+	Copied      int   `json:"copied"`
+	CopiedBytes int64 `json:"copiedBytes"`
+	// files completed by a previous run (checkpoint)
+	Skipped int `json:"skipped"`
+	// existing destination files skipped, overwritten or renamed by the
+	// conflict policy (with the default overwrite policy only a dry run counts
+	// the overwritten files)
+	SkippedExisting int `json:"skippedExisting"`
+	Overwritten     int `json:"overwritten"`
+	Renamed         int `json:"renamed"`
+	// files verified by checksum after the copy
+	Verified int `json:"verified"`
+	// source files and directories deleted by a move
+	Deleted    int          `json:"deleted"`
+	PrunedDirs int          `json:"prunedDirs"`
+	Failed     []*FileError `json:"failed"`
+	// transient failures retried (by all the operations in this process)
+	Retries int64 `json:"retries"`
+	// the copy was canceled, the report is partial
+	Canceled bool `json:"canceled"`
+	// the copied files (with CopyOptions.Manifest)
+	Manifest []*ManifestEntry `json:"manifest,omitempty"`
+	// with DryRun the counters above are planned and every file action is listed
+	DryRun  bool          `json:"dryRun"`
+	Actions []*FileAction `json:"actions,omitempty"`
+}
+
+func (r *CopyReport) plan(action string, f *backends.FileDetails, target string) {
+	if r.DryRun {
+		r.Actions = append(r.Actions, &FileAction{Action: action, Key: f.Key, Target: target, Size: f.Size})
+	}
+}
+
+// Err returns an error summarizing the failed files (nil if none failed)
+func (r *CopyReport) Err() error {
+	return failedErr(r.Failed)
+}
+
+func failedErr(failed []*FileError) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d files failed, %v", len(failed), failed[0])
+}
+
+// CopyDir copies the listed files to the target, when the context is canceled
+// the listing stops and the files in progress are aborted (rolled back)
+func CopyDir(ctx context.Context, task *backends.ListDirTask, target *backends.PathParams, opts *CopyOptions, logger logger.Logger, workers int) (*CopyReport, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	if opts.Verify != "" {
+		if _, err := backends.NewChecksum(opts.Verify); err != nil {
+			return nil, err
+		}
+	}
+	if err := validConflictPolicy(opts.OnConflict); err != nil {
+		return nil, err
+	}
 	fileChan := make(chan *backends.FileDetails, 1000)
 	summary := &backends.ListSummary{}
-	withMeta := task.WithMeta
+	report := &CopyReport{Source: task.Source.Redacted(), Target: target.Redacted(), StartTime: time.Now(),
+		Failed: []*FileError{}, DryRun: opts.DryRun}
+	defer func() {
+		report.EndTime = time.Now()
+	}()
+	retries := backends.Retry.Retries()
 
 	logger.InfoWith("copy task", "from", task.Source, "to", target)
 	client, err := backends.GetNewClient(logger, task.Source)
 	if err != nil {
-		return fmt.Errorf("failed to get list source, %v", err)
+		return nil, fmt.Errorf("failed to get list source, %v", err)
 	}
+	defer backends.CloseClient(client)
+	srcClients, dstClients, err := workerClients(task.Source, target, logger, workers)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClients(srcClients, dstClients)
 
-	errChan := make(chan error, 60)
+	var checkpoint *Checkpoint
+	if opts.Checkpoint != "" && !(opts.DryRun && !fileExists(opts.Checkpoint)) {
+		if checkpoint, err = OpenCheckpoint(opts.Checkpoint); err != nil {
+			return nil, err
+		}
+		defer checkpoint.Close()
+	}
+	fileCopier := newCopier(target, task.WithMeta, opts, checkpoint)
+	progress, stopProgress := startProgress(opts)
+	listChan := fileChan
+	if progress != nil {
+		listChan = make(chan *backends.FileDetails, 1000)
+		go progress.trackListed(listChan, fileChan)
+	}
 
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	var stopped bool
+	errChan := make(chan error, 1)
 	go func(errChan chan error) {
 		var err error
-		err = client.ListDir(fileChan, task, summary)
-		if err != nil {
+		if opts.FilesFrom != "" {
+			err = listFilesFrom(ctx, client, task, opts, listChan, summary, func(key string, err error) {
+				logger.ErrorWith("failed to stat listed file", "src", key, "err", err)
+				lock.Lock()
+				report.Failed = append(report.Failed, &FileError{Key: key, Err: err})
+				stopped = opts.FailFast
+				lock.Unlock()
+			}, logger)
+		} else {
+			err = client.ListDir(ctx, listChan, task, summary)
+		}
+		if err != nil && ctx.Err() == nil {
 			errChan <- fmt.Errorf("failed in list dir, %v", err)
 		}
 	}(errChan)
 
-	wg := sync.WaitGroup{}
-	var transferred int64
+	movedDirs := map[string]bool{}
+	// deleteSource deletes a copied source file (with Move)
+	deleteSource := func(src backends.FSClient, f *backends.FileDetails) {
+		if opts.DryRun {
+			lock.Lock()
+			report.Deleted++
+			report.plan(ActionDelete, f, "")
+			lock.Unlock()
+			return
+		}
+		err := src.Delete(ctx, f.Key)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			logger.ErrorWith("failed to delete the moved source file", "src", f.Key, "err", err)
+			report.Failed = append(report.Failed, &FileError{Key: f.Key, Err: fmt.Errorf("copied but failed to delete the source, %v", err)})
+			stopped = opts.FailFast
+			return
+		}
+		logger.InfoWith("deleted moved source file", "src", f.Key)
+		report.Deleted++
+		movedDirs[path.Dir(f.Key)] = true
+	}
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(i int, fileChan chan *backends.FileDetails, errChan chan error) {
+		go func(worker int, src, dst backends.FSClient) {
 			defer wg.Done()
-			src, err := backends.GetNewClient(logger, task.Source)
-			if err != nil {
-				errChan <- fmt.Errorf("failed to get source, %v", err)
-				return
-			}
+			for f := range fileChan {
+				// with fail fast the rest of the list is drained without copying
+				lock.Lock()
+				skip := stopped
+				lock.Unlock()
+				if skip || ctx.Err() != nil {
+					continue
+				}
+				if checkpoint != nil && checkpoint.IsDone(f) {
+					lock.Lock()
+					report.Skipped++
+					report.plan(ActionSkip, f, "")
+					lock.Unlock()
+					progress.end(nil, f, false)
+					if opts.Move {
+						deleteSource(src, f)
+					}
+					continue
+				}
 
-			dst, err := backends.GetNewClient(logger, target)
-			if err != nil {
-				errChan <- fmt.Errorf("failed to get target, %v", err)
-				return
-			}
+				targetPath := path.Join(target.Path, relativePath(task.Source, f.Key))
+				var resolved string
+				var action conflictAction
+				err := backends.Retry.Do(ctx, logger, func() error {
+					var err error
+					resolved, action, err = fileCopier.resolveConflict(ctx, dst, f, targetPath)
+					return err
+				})
+				if err == nil && action == conflictSkip {
+					logger.DebugWith("skip existing file", "src", f.Key, "dst", targetPath)
+					lock.Lock()
+					report.SkippedExisting++
+					report.plan(ActionSkip, f, targetPath)
+					lock.Unlock()
+					progress.end(nil, f, false)
+					continue
+				}
 
-			for f := range fileChan {
-				relKeyPath := strings.TrimPrefix(f.Key, task.Source.Path)
-				targetPath := path.Join(target.Path, relKeyPath)
-
-				logger.DebugWith("copy file", "src", f.Key, "dst", targetPath,
-					"bucket", target.Bucket, "size", f.Size, "mtime", f.Mtime)
-				err = copyFile(dst, src, f, targetPath, withMeta)
-				if err != nil {
-					errChan <- fmt.Errorf("failed in copy file, %v", err)
-					break
+				active := progress.begin(worker, f)
+				var checksum string
+				if err == nil && !opts.DryRun {
+					targetPath = resolved
+					logger.DebugWith("copy file", "src", f.Key, "dst", targetPath,
+						"bucket", target.Bucket, "size", f.Size, "mtime", f.Mtime)
+					err = backends.Retry.Do(ctx, logger, func() error {
+						var err error
+						active.reset()
+						checksum, err = fileCopier.copyFile(ctx, dst, src, f, targetPath, active)
+						return err
+					})
+				}
+				progress.end(active, f, err != nil && ctx.Err() == nil)
+
+				lock.Lock()
+				if err != nil && ctx.Err() != nil {
+					logger.WarnWith("copy canceled", "src", f.Key, "dst", targetPath)
+				} else if err != nil {
+					logger.ErrorWith("failed to copy file", "src", f.Key, "dst", targetPath, "err", err)
+					report.Failed = append(report.Failed, &FileError{Key: f.Key, Err: err})
+					stopped = opts.FailFast
+				} else if opts.DryRun {
+					report.Copied++
+					report.CopiedBytes += f.Size
+					switch action {
+					case conflictOverwrite:
+						report.Overwritten++
+						report.plan(ActionOverwrite, f, targetPath)
+					case conflictRename:
+						report.Renamed++
+						report.plan(ActionRename, f, resolved)
+					default:
+						report.plan(ActionCopy, f, targetPath)
+					}
+				} else {
+					report.Copied++
+					report.CopiedBytes += f.Size
+					switch action {
+					case conflictOverwrite:
+						report.Overwritten++
+					case conflictRename:
+						report.Renamed++
+					}
+					if opts.Verify != "" {
+						report.Verified++
+					}
+					if opts.Manifest {
+						report.Manifest = append(report.Manifest, &ManifestEntry{
+							Key: f.Key, Target: targetPath, Size: f.Size, Mtime: f.Mtime, Checksum: checksum})
+					}
+				}
+				lock.Unlock()
+				if err == nil && opts.Move {
+					deleteSource(src, f)
 				}
-				atomic.AddInt64(&transferred, 1)
 			}
-		}(i, fileChan, errChan)
+		}(i, srcClients[i], dstClients[i])
 	}
 
 	wg.Wait()
+	stopProgress()
+	if opts.Move && opts.PruneEmptyDirs && !opts.DryRun && ctx.Err() == nil {
+		report.PrunedDirs = pruneEmptyDirs(ctx, client, task.Source, movedDirs, logger)
+	}
+	report.TotalFiles, report.TotalBytes = summary.TotalFiles, summary.TotalBytes
+	report.Retries = backends.Retry.Retries() - retries
+	report.Canceled = ctx.Err() != nil
+	logger.Info("Total files: %d,  Total size: %d KB, Transferred %d files, Verified %d files, Skipped %d files, Failed %d files, Retries %d\n",
+		summary.TotalFiles, summary.TotalBytes/1024, report.Copied, report.Verified, report.Skipped, len(report.Failed), report.Retries)
+	if (opts.OnConflict != "" && opts.OnConflict != ConflictOverwrite) || opts.DryRun {
+		logger.Info("Existing files: skipped %d, overwritten %d, renamed %d\n", report.SkippedExisting, report.Overwritten, report.Renamed)
+	}
+	if opts.Move {
+		logger.Info("Moved: deleted %d source files, removed %d empty dirs\n", report.Deleted, report.PrunedDirs)
+	}
+
 	select {
 	case err := <-errChan:
-		logger.ErrorWith("copy loop failed", "err", err)
+		return report, err
 	default:
+	}
+	if report.Canceled {
+		return report, fmt.Errorf("copy canceled, %v", ctx.Err())
+	}
+	return report, report.Err()
+}
+
+// pruneEmptyDirs removes the directories of the moved files and their parents
+// (below the source path) if they are empty, object stores have no directories
+func pruneEmptyDirs(ctx context.Context, client backends.FSClient, source *backends.PathParams, dirs map[string]bool, logger logger.Logger) int {
+	switch source.Kind {
+	case "", "file", "sftp", "scp":
+	default:
+		return 0
+	}
 
+	// children are removed before their parents
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
 	}
+	sort.Slice(sorted, func(i, j int) bool { return strings.Count(sorted[i], "/") > strings.Count(sorted[j], "/") })
 
-	logger.Info("Total files: %d,  Total size: %d KB, Transferred %d files\n",
-		summary.TotalFiles, summary.TotalBytes/1024, transferred)
-	return nil
+	root := path.Clean(filepath.ToSlash(source.Path))
+	pruned := 0
+	tried := map[string]bool{}
+	for _, dir := range sorted {
+		for strings.HasPrefix(dir, root+"/") && !tried[dir] {
+			tried[dir] = true
+			// fails if the directory is not empty
+			if err := client.Delete(ctx, dir); err != nil {
+				break
+			}
+			logger.InfoWith("removed empty source dir", "dir", dir)
+			pruned++
+			dir = path.Dir(dir)
+		}
+	}
+	return pruned
 }
 
-func copyFile(dst, src backends.FSClient, fileObj *backends.FileDetails, targetPath string, withMeta bool) error {
+// workerClients returns a source and destination client per worker, the clients
+// are created before any listing starts since the constructors normalize the params
+func workerClients(source, target *backends.PathParams, logger logger.Logger, workers int) ([]backends.FSClient, []backends.FSClient, error) {
+	srcClients := make([]backends.FSClient, workers)
+	dstClients := make([]backends.FSClient, workers)
+	var err error
+	for i := 0; i < workers; i++ {
+		if srcClients[i], err = backends.GetNewClient(logger, source); err != nil {
+			closeClients(srcClients, dstClients)
+			return nil, nil, fmt.Errorf("failed to get source, %v", err)
+		}
+		if dstClients[i], err = backends.GetNewClient(logger, target); err != nil {
+			closeClients(srcClients, dstClients)
+			return nil, nil, fmt.Errorf("failed to get target, %v", err)
+		}
+	}
+	return srcClients, dstClients, nil
+}
 
-	reader, err := src.Reader(fileObj.Key)
-	if err != nil {
-		return err
+// closeClients closes the worker clients (nil clients are skipped)
+func closeClients(clientLists ...[]backends.FSClient) {
+	for _, clients := range clientLists {
+		for _, client := range clients {
+			if client != nil {
+				backends.CloseClient(client)
+			}
+		}
 	}
-	defer reader.Close()
+}
 
-	opts := backends.FileMeta{}
-	if withMeta {
+// copier copies single files to the target, optionally verifying the copied
+// content and recording the completed files in a checkpoint journal
+type copier struct {
+	target     *backends.PathParams
+	withMeta   bool
+	verify     string
+	onConflict string
+	dryRun     bool
+	checkpoint *Checkpoint
+}
+
+func newCopier(target *backends.PathParams, withMeta bool, opts *CopyOptions, checkpoint *Checkpoint) *copier {
+	return &copier{target: target, withMeta: withMeta, verify: opts.Verify, onConflict: opts.OnConflict,
+		dryRun: opts.DryRun, checkpoint: checkpoint}
+}
+
+// copyFile copies a file, partial uploads are resumed if there is a checkpoint
+// and the destination supports it. the copied bytes are counted in active (if not
+// nil), returns the verified checksum ("<algo>:<hex>", empty if not verified)
+func (c *copier) copyFile(ctx context.Context, dst, src backends.FSClient, fileObj *backends.FileDetails,
+	targetPath string, active *activeFile) (string, error) {
+
+	opts := backends.FileMeta{Size: fileObj.Size}
+	if c.withMeta {
 		opts.Mode = fileObj.Mode
 		opts.Mtime = fileObj.Mtime
 	}
 
-	writer, err := dst.Writer(targetPath, &opts)
+	// server side copy, verifying needs to read the data so it is streamed
+	if copier, ok := dst.(backends.FSServerCopier); ok && c.verify == "" && copier.CanCopyFrom(src) {
+		if err := copier.CopyFrom(ctx, src, fileObj.Key, targetPath, &opts); err != nil {
+			return "", err
+		}
+		active.add(fileObj.Size)
+		if c.checkpoint != nil {
+			return "", c.checkpoint.Done(fileObj, "")
+		}
+		return "", nil
+	}
+
+	reader, err := src.Reader(ctx, fileObj.Key)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer reader.Close()
+
+	var writer io.WriteCloser
+	var offset int64
+	if resumer, ok := dst.(backends.FSResumer); ok && c.checkpoint != nil {
+		// the upload of a previous version of the file cannot be resumed
+		if stale := c.checkpoint.StaleUpload(fileObj); stale != nil {
+			if err := resumer.AbortUpload(ctx, targetPath, stale); err != nil {
+				return "", err
+			}
+		}
+		writer, offset, err = resumer.ResumeWriter(ctx, targetPath, &opts, c.checkpoint.UploadState(fileObj),
+			func(state *backends.UploadState) {
+				c.checkpoint.SaveUpload(fileObj, state)
+			})
+	} else {
+		writer, err = dst.Writer(ctx, targetPath, &opts)
 	}
-	_, err = io.CopyN(writer, reader, fileObj.Size)
 	if err != nil {
-		writer.Close()
+		return "", err
+	}
+
+	// the checksum is computed while streaming, including the resumed part
+	input := backends.NewContextReader(ctx, reader)
+	var sum hash.Hash
+	if c.verify != "" {
+		if sum, err = backends.NewChecksum(c.verify); err != nil {
+			writer.Close()
+			return "", err
+		}
+		input = io.TeeReader(input, sum)
+	}
+
+	if offset > 0 && sum != nil {
+		_, err = io.CopyN(ioutil.Discard, input, offset)
+	} else if offset > 0 {
+		err = skipBytes(reader, offset)
+	}
+	if err == nil {
+		var output io.Writer = writer
+		if active != nil {
+			active.add(offset)
+			output = io.MultiWriter(writer, active)
+		}
+		_, err = io.CopyN(output, input, fileObj.Size-offset)
+	}
+	if err != nil {
+		if aborter, ok := writer.(backends.FSAborter); ok {
+			aborter.Abort()
+		} else {
+			writer.Close()
+		}
+		return "", err
+	}
+	var checksum string
+	if sum != nil {
+		checksum = backends.FormatChecksum(c.verify, sum.Sum(nil))
+	}
+	if checksummer, ok := writer.(backends.FSChecksummer); ok && sum != nil {
+		checksummer.SetChecksum(checksum)
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	if sum != nil {
+		if err := c.verifyFile(ctx, dst, writer, targetPath, sum.Sum(nil)); err != nil {
+			return "", err
+		}
+	}
+	if c.checkpoint != nil {
+		var etag string
+		if tagger, ok := writer.(backends.FSETagger); ok {
+			etag = tagger.ETag()
+		}
+		return checksum, c.checkpoint.Done(fileObj, etag)
+	}
+	return checksum, nil
+}
+
+// skipBytes skips the part of the source which was already uploaded
+func skipBytes(reader io.Reader, offset int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
 		return err
 	}
-	return writer.Close()
+	_, err := io.CopyN(ioutil.Discard, reader, offset)
+	return err
+}
+
+// relativePath returns the listed file key relative to the listed path, s3 keys
+// include the bucket name which is removed as well
+func relativePath(params *backends.PathParams, key string) string {
+	if params.Kind == "s3" {
+		key = strings.TrimPrefix(key, params.Bucket+"/")
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(key, params.Path), "/")
 }
@@ -0,0 +1,154 @@
+package operators
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nuclio/logger"
+	"github.com/v3io/xcp/backends"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FilesFromStatWorkers is the number of concurrent Stat requests for the
+// CopyOptions.FilesFrom entries without a size
+var FilesFromStatWorkers = 16
+
+// FilesFromEntry is a json line of a FilesFrom list, the key is relative to the
+// source path, the file is checked with Stat unless the size is set (and the
+// mtime, if a time filter or option depends on it)
+type FilesFromEntry struct {
+	Key   string    `json:"key"`
+	Size  *int64    `json:"size,omitempty"`
+	Mtime time.Time `json:"mtime"`
+	Mode  uint32    `json:"mode,omitempty"`
+}
+
+// listFilesFrom sends the files of a FilesFrom list ("-" for stdin) instead of
+// listing the source, the filters of the task are applied as with ListDir and
+// the entries which cannot be checked (missing) are passed to onError
+func listFilesFrom(ctx context.Context, client backends.FSClient, task *backends.ListDirTask, opts *CopyOptions,
+	fileChan chan *backends.FileDetails, summary *backends.ListSummary, onError func(key string, err error), logger logger.Logger) error {
+
+	defer close(fileChan)
+	filesFrom := opts.FilesFrom
+	var input io.Reader = os.Stdin
+	if filesFrom != "-" {
+		f, err := os.Open(filesFrom)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	needMtime := filesFromNeedMtime(task, opts)
+	entries := make(chan *FilesFromEntry, 1000)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < FilesFromStatWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				if ctx.Err() != nil {
+					continue
+				}
+				key := sourceKey(task.Source, entry.Key)
+				fileDetails := &backends.FileDetails{Key: key, Mtime: entry.Mtime, Mode: entry.Mode}
+				if entry.Size != nil && (!entry.Mtime.IsZero() || !needMtime) {
+					fileDetails.Size = *entry.Size
+				} else {
+					err := backends.Retry.Do(ctx, logger, func() error {
+						var err error
+						fileDetails, err = client.Stat(ctx, key)
+						return err
+					})
+					if err != nil {
+						if ctx.Err() == nil {
+							onError(key, err)
+						}
+						continue
+					}
+				}
+				if !backends.IsMatch(task, entry.Key, fileDetails.Mtime, fileDetails.Size) {
+					continue
+				}
+
+				lock.Lock()
+				summary.TotalBytes += fileDetails.Size
+				summary.TotalFiles += 1
+				lock.Unlock()
+				select {
+				case fileChan <- fileDetails:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	err := readFilesFrom(ctx, input, entries)
+	close(entries)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to read %s, %v", filesFrom, err)
+	}
+	return nil
+}
+
+// filesFromNeedMtime returns true if the list entries need the file mtime, for
+// the time filters, the copied metadata, the checkpoint or the overwrite-if-newer
+// policy, entries without an mtime are then checked with Stat
+func filesFromNeedMtime(task *backends.ListDirTask, opts *CopyOptions) bool {
+	return !task.Since.IsZero() || !task.Until.IsZero() || task.WithMeta || opts.Checkpoint != "" ||
+		opts.OnConflict == ConflictOverwriteIfNewer
+}
+
+// readFilesFrom parses the list lines, a path per line or json lines
+// (FilesFromEntry), empty lines are ignored
+func readFilesFrom(ctx context.Context, input io.Reader, entries chan *FilesFromEntry) error {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		entry := FilesFromEntry{Key: text}
+		if strings.HasPrefix(text, "{") {
+			entry = FilesFromEntry{}
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		entry.Key = strings.TrimPrefix(path.Clean("/"+entry.Key), "/")
+		if entry.Key == "" {
+			return fmt.Errorf("line %d: missing key", line)
+		}
+
+		select {
+		case entries <- &entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// sourceKey returns the key of a path relative to the source path, the reverse
+// of relativePath
+func sourceKey(params *backends.PathParams, relPath string) string {
+	key := path.Join(params.Path, relPath)
+	if params.Kind == "s3" {
+		key = params.Bucket + "/" + key
+	}
+	return key
+}
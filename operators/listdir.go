@@ -1,12 +1,13 @@
 package operators
 
 import (
+	"context"
 	"fmt"
 	"github.com/nuclio/logger"
 	"github.com/v3io/xcp/backends"
 )
 
-func ListDir(task *backends.ListDirTask, logger logger.Logger) (*listResults, error) {
+func ListDir(ctx context.Context, task *backends.ListDirTask, logger logger.Logger) (*listResults, error) {
 
 	list := listResults{
 		fileChan: make(chan *backends.FileDetails, 1000),
@@ -21,8 +22,9 @@ func ListDir(task *backends.ListDirTask, logger logger.Logger) (*listResults, er
 	}
 
 	go func(errChan chan error) {
+		defer backends.CloseClient(client)
 		var err error
-		err = client.ListDir(list.fileChan, task, list.summary)
+		err = client.ListDir(ctx, list.fileChan, task, list.summary)
 		if err != nil {
 			errChan <- fmt.Errorf("failed in list dir, %v", err)
 			fmt.Println(err)
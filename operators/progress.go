@@ -0,0 +1,232 @@
+package operators
+
+import (
+	"github.com/v3io/xcp/backends"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProgressInterval is the interval between progress callbacks
+const DefaultProgressInterval = time.Second
+
+// Progress is a snapshot of a running copy, the totals grow while listing
+type Progress struct {
+	ListedFiles int
+	ListedBytes int64
+	ListDone    bool
+	// completed files (copied, skipped or failed) and their bytes
+	DoneFiles   int
+	DoneBytes   int64
+	FailedFiles int
+	// bytes transferred, including the files in progress
+	Bytes int64
+	// bytes per second (smoothed) and estimated time left (0 if unknown)
+	Throughput float64
+	ETA        time.Duration
+	Elapsed    time.Duration
+	Active     []*ActiveFile
+	// the last snapshot, sent when the copy is done
+	Finished bool
+}
+
+// ActiveFile is a file being copied by a worker
+type ActiveFile struct {
+	Worker int
+	Key    string
+	Size   int64
+	Bytes  int64
+}
+
+// ProgressToChannel returns a progress callback which sends the snapshots to
+// ch, snapshots are dropped while ch is full (the final one is always sent)
+func ProgressToChannel(ch chan<- *Progress) func(*Progress) {
+	return func(p *Progress) {
+		if p.Finished {
+			ch <- p
+			return
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// progressTracker counts the listed and copied files, the bytes of the files
+// in progress are counted by the copy streams
+type progressTracker struct {
+	listedFiles int64
+	listedBytes int64
+	listDone    int32
+	doneFiles   int64
+	doneBytes   int64
+	failedFiles int64
+
+	lock      sync.Mutex
+	active    map[*activeFile]bool
+	start     time.Time
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64
+}
+
+func newProgressTracker() *progressTracker {
+	now := time.Now()
+	return &progressTracker{active: map[*activeFile]bool{}, start: now, lastTime: now}
+}
+
+// activeFile counts the bytes written by a copy stream (io.Writer)
+type activeFile struct {
+	worker int
+	file   *backends.FileDetails
+	bytes  int64
+}
+
+func (a *activeFile) Write(p []byte) (int, error) {
+	atomic.AddInt64(&a.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+func (a *activeFile) add(bytes int64) {
+	if a != nil {
+		atomic.AddInt64(&a.bytes, bytes)
+	}
+}
+
+func (a *activeFile) reset() {
+	if a != nil {
+		atomic.StoreInt64(&a.bytes, 0)
+	}
+}
+
+func (t *progressTracker) listed(f *backends.FileDetails) {
+	if t != nil {
+		atomic.AddInt64(&t.listedFiles, 1)
+		atomic.AddInt64(&t.listedBytes, f.Size)
+	}
+}
+
+func (t *progressTracker) listFinished() {
+	if t != nil {
+		atomic.StoreInt32(&t.listDone, 1)
+	}
+}
+
+// begin marks a file as in progress by a worker, returns nil without a tracker
+func (t *progressTracker) begin(worker int, f *backends.FileDetails) *activeFile {
+	if t == nil {
+		return nil
+	}
+	active := &activeFile{worker: worker, file: f}
+	t.lock.Lock()
+	t.active[active] = true
+	t.lock.Unlock()
+	return active
+}
+
+// end marks a file (in progress or skipped) as done
+func (t *progressTracker) end(active *activeFile, f *backends.FileDetails, failed bool) {
+	if t == nil {
+		return
+	}
+	if active != nil {
+		t.lock.Lock()
+		delete(t.active, active)
+		t.lock.Unlock()
+	}
+	atomic.AddInt64(&t.doneFiles, 1)
+	atomic.AddInt64(&t.doneBytes, f.Size)
+	if failed {
+		atomic.AddInt64(&t.failedFiles, 1)
+	}
+}
+
+// snapshot returns the current progress and updates the throughput estimate
+func (t *progressTracker) snapshot() *Progress {
+	p := Progress{
+		ListedFiles: int(atomic.LoadInt64(&t.listedFiles)),
+		ListedBytes: atomic.LoadInt64(&t.listedBytes),
+		ListDone:    atomic.LoadInt32(&t.listDone) == 1,
+		DoneFiles:   int(atomic.LoadInt64(&t.doneFiles)),
+		DoneBytes:   atomic.LoadInt64(&t.doneBytes),
+		FailedFiles: int(atomic.LoadInt64(&t.failedFiles)),
+	}
+	p.Bytes = p.DoneBytes
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for active := range t.active {
+		bytes := atomic.LoadInt64(&active.bytes)
+		p.Bytes += bytes
+		p.Active = append(p.Active, &ActiveFile{
+			Worker: active.worker, Key: active.file.Key, Size: active.file.Size, Bytes: bytes})
+	}
+	sort.Slice(p.Active, func(i, j int) bool { return p.Active[i].Worker < p.Active[j].Worker })
+
+	now := time.Now()
+	p.Elapsed = now.Sub(t.start)
+	if interval := now.Sub(t.lastTime).Seconds(); interval > 0 {
+		rate := float64(p.Bytes-t.lastBytes) / interval
+		if t.lastTime.Equal(t.start) {
+			t.rate = rate
+		} else {
+			// exponential moving average, smooths bursts between samples
+			t.rate = 0.3*rate + 0.7*t.rate
+		}
+		t.lastBytes, t.lastTime = p.Bytes, now
+	}
+	p.Throughput = t.rate
+	if p.Throughput > 0 && p.ListedBytes > p.Bytes {
+		p.ETA = time.Duration(float64(p.ListedBytes-p.Bytes) / p.Throughput * float64(time.Second))
+	}
+	return &p
+}
+
+// startProgress starts reporting the progress to the options callback, returns
+// a nil tracker if there is no callback, stop sends the final progress
+func startProgress(opts *CopyOptions) (tracker *progressTracker, stop func()) {
+	if opts.OnProgress == nil {
+		return nil, func() {}
+	}
+	tracker = newProgressTracker()
+	stopChan, done := make(chan struct{}), make(chan struct{})
+	go tracker.report(opts.OnProgress, opts.ProgressInterval, stopChan, done)
+	return tracker, func() {
+		close(stopChan)
+		<-done
+	}
+}
+
+// trackListed forwards the listed files to out and counts them
+func (t *progressTracker) trackListed(in, out chan *backends.FileDetails) {
+	for f := range in {
+		t.listed(f)
+		out <- f
+	}
+	t.listFinished()
+	close(out)
+}
+
+// report calls the callback every interval until stop is closed, and once
+// more with the final progress
+func (t *progressTracker) report(callback func(*Progress), interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			callback(t.snapshot())
+		case <-stop:
+			p := t.snapshot()
+			p.Finished = true
+			callback(p)
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package operators
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ManifestEntry is a copied file in the report manifest
+type ManifestEntry struct {
+	Key    string    `json:"key"`
+	Target string    `json:"target"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	// verified checksum ("<algo>:<hex>"), with CopyOptions.Verify
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// planned file actions, reported by a dry run
+const (
+	ActionCopy      = "copy"
+	ActionOverwrite = "overwrite"
+	ActionRename    = "rename"
+	ActionSkip      = "skip"
+	ActionDelete    = "delete"
+)
+
+// FileAction is the action a dry run plans for a file, the target is the
+// destination path (empty for skipped and deleted source files)
+type FileAction struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Target string `json:"target,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+func (e *FileError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	}{Key: e.Key, Error: e.Err.Error()})
+}
+
+// WriteReport writes a copy or sync report as a json file
+func WriteReport(path string, report interface{}) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report %s, %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package operators
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/nuclio/logger"
+	"github.com/v3io/xcp/backends"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type SyncOptions struct {
+	CopyOptions
+	// compare files with the same size by content checksum instead of mtime
+	Checksum bool
+	// delete destination files which do not exist in the source
+	Delete bool
+}
+
+type SyncReport struct {
+	// source and target params with the secrets redacted
+	Source    *backends.PathParams `json:"source"`
+	Target    *backends.PathParams `json:"target"`
+	StartTime time.Time            `json:"startTime"`
+	EndTime   time.Time            `json:"endTime"`
+	// new or changed files copied to the destination
+	Copied []*backends.FileDetails `json:"copied"`
+	// destination files deleted (missing in the source)
+	Deleted   []*backends.FileDetails `json:"deleted"`
+	Failed    []*FileError            `json:"failed"`
+	Unchanged int                     `json:"unchanged"`
+	Retries   int64                   `json:"retries"`
+	DryRun    bool                    `json:"dryRun"`
+	// the sync was canceled, the report is partial
+	Canceled bool `json:"canceled"`
+	// with DryRun every file action is listed
+	Actions []*FileAction `json:"actions,omitempty"`
+}
+
+func (r *SyncReport) plan(action string, f *backends.FileDetails, target string) {
+	if r.DryRun {
+		r.Actions = append(r.Actions, &FileAction{Action: action, Key: f.Key, Target: target, Size: f.Size})
+	}
+}
+
+type syncItem struct {
+	src     *backends.FileDetails
+	dst     *backends.FileDetails
+	relPath string
+}
+
+// SyncDir copies only new or changed source files to the target, files are
+// compared by size and mtime (or checksum), and optionally deletes destination
+// files which are missing in the source. when the context is canceled the
+// listing stops and the files in progress are aborted (rolled back)
+func SyncDir(ctx context.Context, task *backends.ListDirTask, target *backends.PathParams, opts *SyncOptions, logger logger.Logger, workers int) (*SyncReport, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	report := &SyncReport{Source: task.Source.Redacted(), Target: target.Redacted(), StartTime: time.Now(),
+		Failed: []*FileError{}, DryRun: opts.DryRun}
+	retries := backends.Retry.Retries()
+	defer func() {
+		report.Retries = backends.Retry.Retries() - retries
+		report.EndTime = time.Now()
+	}()
+
+	if opts.Verify != "" {
+		if _, err := backends.NewChecksum(opts.Verify); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.InfoWith("sync task", "from", task.Source, "to", target,
+		"checksum", opts.Checksum, "delete", opts.Delete, "dryRun", opts.DryRun)
+	dstFiles, err := listTarget(ctx, task, target, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := backends.GetNewClient(logger, task.Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list source, %v", err)
+	}
+	defer backends.CloseClient(client)
+
+	srcClients, dstClients, err := workerClients(task.Source, target, logger, workers)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClients(srcClients, dstClients)
+	fileCopier := newCopier(target, task.WithMeta, &opts.CopyOptions, nil)
+	progress, stopProgress := startProgress(&opts.CopyOptions)
+
+	// list the source without the size/time filters so every existing source
+	// file is known when deleting, the filters are applied when comparing
+	fileChan := make(chan *backends.FileDetails, 1000)
+	listTask := *task
+	listTask.Since, listTask.Until = time.Time{}, time.Time{}
+	listTask.MinSize, listTask.MaxSize = 0, 0
+	listTask.InclEmpty = true
+	errChan := make(chan error, 1)
+	go func() {
+		if err := client.ListDir(ctx, fileChan, &listTask, &backends.ListSummary{}); err != nil && ctx.Err() == nil {
+			errChan <- fmt.Errorf("failed in list dir, %v", err)
+		}
+	}()
+
+	itemChan := make(chan *syncItem, 1000)
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	var stopped bool
+	fail := func(key string, err error) {
+		logger.ErrorWith("failed to sync file", "src", key, "err", err)
+		lock.Lock()
+		report.Failed = append(report.Failed, &FileError{Key: key, Err: err})
+		stopped = opts.FailFast
+		lock.Unlock()
+	}
+
+	// syncFile compares (by checksum) and copies a changed file, failures are
+	// recorded in the report and returned
+	syncFile := func(src, dst backends.FSClient, item *syncItem, active *activeFile) error {
+		var err error
+		changed := true
+		if item.dst != nil && opts.Checksum {
+			err = backends.Retry.Do(ctx, logger, func() error {
+				changed, err = checksumDiffers(ctx, src, dst, item.src, item.dst)
+				return err
+			})
+			if err != nil && ctx.Err() != nil {
+				return err
+			} else if err != nil {
+				fail(item.src.Key, fmt.Errorf("failed to compare, %v", err))
+				return err
+			}
+		}
+
+		targetPath := path.Join(target.Path, item.relPath)
+		if changed && !opts.DryRun {
+			logger.DebugWith("sync file", "src", item.src.Key, "dst", targetPath, "size", item.src.Size)
+			err := backends.Retry.Do(ctx, logger, func() error {
+				active.reset()
+				_, err := fileCopier.copyFile(ctx, dst, src, item.src, targetPath, active)
+				return err
+			})
+			if err != nil && ctx.Err() != nil {
+				logger.WarnWith("sync canceled", "src", item.src.Key, "dst", targetPath)
+				return err
+			} else if err != nil {
+				fail(item.src.Key, err)
+				return err
+			}
+		}
+
+		lock.Lock()
+		if !changed {
+			report.Unchanged++
+			report.plan(ActionSkip, item.src, targetPath)
+		} else if _, exists := dstFiles[item.relPath]; exists {
+			report.Copied = append(report.Copied, item.src)
+			report.plan(ActionOverwrite, item.src, targetPath)
+		} else {
+			report.Copied = append(report.Copied, item.src)
+			report.plan(ActionCopy, item.src, targetPath)
+		}
+		lock.Unlock()
+		return nil
+	}
+
+	for i := 0; i < workers; i++ {
+		worker, src, dst := i, srcClients[i], dstClients[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range itemChan {
+				// with fail fast the rest of the items are drained without copying
+				lock.Lock()
+				skip := stopped
+				lock.Unlock()
+				if skip || ctx.Err() != nil {
+					continue
+				}
+
+				active := progress.begin(worker, item.src)
+				err := syncFile(src, dst, item, active)
+				progress.end(active, item.src, err != nil && ctx.Err() == nil)
+			}
+		}()
+	}
+
+	seen := map[string]bool{}
+	for f := range fileChan {
+		relPath := relativePath(task.Source, f.Key)
+		seen[relPath] = true
+		matchPath := relPath
+		if matchPath == "" {
+			// the source is a single file
+			matchPath = path.Base(f.Key)
+		}
+		if !backends.IsMatch(task, matchPath, f.Mtime, f.Size) {
+			continue
+		}
+
+		dstFile := dstFiles[relPath]
+		if dstFile != nil && dstFile.Size == f.Size && !opts.Checksum &&
+			!f.Mtime.Truncate(time.Second).After(dstFile.Mtime.Truncate(time.Second)) {
+			lock.Lock()
+			report.Unchanged++
+			report.plan(ActionSkip, f, path.Join(target.Path, relPath))
+			lock.Unlock()
+			continue
+		}
+		if dstFile != nil && dstFile.Size != f.Size {
+			dstFile = nil
+		}
+		progress.listed(f)
+		itemChan <- &syncItem{src: f, dst: dstFile, relPath: relPath}
+	}
+	progress.listFinished()
+	close(itemChan)
+	wg.Wait()
+	stopProgress()
+
+	select {
+	case err := <-errChan:
+		return report, err
+	default:
+	}
+	if ctx.Err() != nil {
+		report.Canceled = true
+		return report, fmt.Errorf("sync canceled, %v", ctx.Err())
+	}
+	if err := failedErr(report.Failed); err != nil {
+		return report, err
+	}
+
+	if opts.Delete {
+		if err := deleteExtraneous(ctx, task, target, dstFiles, seen, report, logger); err != nil {
+			return report, err
+		}
+	}
+
+	logger.Info("Sync copied %d files, deleted %d files, %d files unchanged, Retries %d\n",
+		len(report.Copied), len(report.Deleted), report.Unchanged, backends.Retry.Retries()-retries)
+	return report, nil
+}
+
+// listTarget returns the destination files by their path relative to the target
+func listTarget(ctx context.Context, task *backends.ListDirTask, target *backends.PathParams, logger logger.Logger) (map[string]*backends.FileDetails, error) {
+	client, err := backends.GetNewClient(logger, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list target, %v", err)
+	}
+	defer backends.CloseClient(client)
+
+	fileChan := make(chan *backends.FileDetails, 1000)
+	listTask := backends.ListDirTask{Source: target, Recursive: task.IsRecursive(), MaxDepth: task.MaxDepth,
+		Hidden: task.Hidden, InclEmpty: true}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- client.ListDir(ctx, fileChan, &listTask, &backends.ListSummary{})
+	}()
+
+	files := map[string]*backends.FileDetails{}
+	for f := range fileChan {
+		files[relativePath(target, f.Key)] = f
+	}
+	if err := <-errChan; err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed in list target dir, %v", err)
+	}
+	return files, nil
+}
+
+// deleteExtraneous deletes destination files which were not found in the source
+// and match the source name filters
+func deleteExtraneous(ctx context.Context, task *backends.ListDirTask, target *backends.PathParams,
+	dstFiles map[string]*backends.FileDetails, seen map[string]bool, report *SyncReport, logger logger.Logger) error {
+
+	client, err := backends.GetNewClient(logger, target)
+	if err != nil {
+		return fmt.Errorf("failed to get target, %v", err)
+	}
+	defer backends.CloseClient(client)
+
+	nameTask := backends.ListDirTask{Source: task.Source, Hidden: task.Hidden, InclEmpty: true, Filter: task.Filter,
+		PathRegexp: task.PathRegexp, MinDepth: task.MinDepth, MaxDepth: task.MaxDepth}
+	for relPath, f := range dstFiles {
+		if seen[relPath] || !backends.IsMatch(&nameTask, relPath, f.Mtime, f.Size) {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			report.Canceled = true
+			return fmt.Errorf("sync canceled, %v", ctx.Err())
+		}
+		report.Deleted = append(report.Deleted, f)
+		report.plan(ActionDelete, f, "")
+		if report.DryRun {
+			continue
+		}
+		logger.DebugWith("delete file", "key", f.Key)
+		if err := client.Delete(ctx, f.Key); err != nil {
+			return fmt.Errorf("failed to delete %s, %v", f.Key, err)
+		}
+	}
+	return nil
+}
+
+// checksumDiffers compares the md5 checksum of the source and destination files,
+// a checksum stored as destination metadata (by -verify) is used if it is md5
+func checksumDiffers(ctx context.Context, src, dst backends.FSClient, srcFile, dstFile *backends.FileDetails) (bool, error) {
+	srcSum, err := fileChecksum(ctx, src, srcFile.Key, "md5")
+	if err != nil {
+		return false, err
+	}
+
+	stat, err := dst.Stat(ctx, dstFile.Key)
+	if err != nil {
+		return false, err
+	}
+	if algo, stored := backends.ParseChecksum(stat.Checksum); algo == "md5" {
+		return stored != hex.EncodeToString(srcSum), nil
+	}
+
+	dstSum, err := fileChecksum(ctx, dst, dstFile.Key, "md5")
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(srcSum, dstSum), nil
+}
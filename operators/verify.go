@@ -0,0 +1,68 @@
+package operators
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/v3io/xcp/backends"
+	"io"
+	"path"
+	"strings"
+)
+
+// verifyFile compares the source checksum with the destination etag (md5 of
+// single part s3 uploads) or with the checksum of the re-read destination, a
+// corrupted destination file is deleted
+func (c *copier) verifyFile(ctx context.Context, dst backends.FSClient, writer io.Writer, targetPath string, expected []byte) error {
+	key := targetKey(c.target, targetPath)
+	actual, err := c.destinationChecksum(ctx, dst, writer, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to verify %s", key)
+	}
+	if actual == hex.EncodeToString(expected) {
+		return nil
+	}
+
+	dst.Delete(ctx, key)
+	return errors.Wrapf(backends.ErrChecksumMismatch, "%s %s expected %x got %s", key, c.verify, expected, actual)
+}
+
+func (c *copier) destinationChecksum(ctx context.Context, dst backends.FSClient, writer io.Writer, key string) (string, error) {
+	if tagger, ok := writer.(backends.FSETagger); ok && strings.ToLower(c.verify) == "md5" {
+		// multipart etags ("<md5>-<parts>") are not the content md5
+		etag := strings.Trim(tagger.ETag(), "\"")
+		if len(etag) == 32 {
+			return strings.ToLower(etag), nil
+		}
+	}
+
+	sum, err := fileChecksum(ctx, dst, key, c.verify)
+	return hex.EncodeToString(sum), err
+}
+
+// fileChecksum reads a file and returns its checksum
+func fileChecksum(ctx context.Context, client backends.FSClient, key, algo string) ([]byte, error) {
+	sum, err := backends.NewChecksum(algo)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := client.Reader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(sum, reader); err != nil {
+		return nil, err
+	}
+	return sum.Sum(nil), nil
+}
+
+// targetKey returns the key of a written target path as used by the readers,
+// s3 keys include the bucket name
+func targetKey(target *backends.PathParams, targetPath string) string {
+	if target.Kind == "s3" {
+		return path.Join(target.Bucket, targetPath)
+	}
+	return targetPath
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nuclio/logger"
+	"github.com/v3io/xcp/operators"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progressPrinter returns a progress callback and its interval, a progress bar
+// (on stderr) when running on a terminal, periodic log lines otherwise
+func progressPrinter(logger logger.Logger) (func(*operators.Progress), time.Duration) {
+	if !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return func(p *operators.Progress) {
+			if p.Finished {
+				return
+			}
+			active := make([]string, 0, len(p.Active))
+			for _, f := range p.Active {
+				active = append(active, fmt.Sprintf("%d:%s", f.Worker, f.Key))
+			}
+			logger.InfoWith("progress", "files", fmt.Sprintf("%d/%d", p.DoneFiles, p.ListedFiles),
+				"bytes", fmt.Sprintf("%s/%s", byteSize(p.Bytes), byteSize(p.ListedBytes)),
+				"throughput", byteSize(int64(p.Throughput))+"/s", "eta", eta(p), "active", active)
+		}, 10 * time.Second
+	}
+
+	return func(p *operators.Progress) {
+		var percent float64
+		if p.ListedBytes > 0 {
+			percent = float64(p.Bytes) / float64(p.ListedBytes)
+		} else if p.ListDone {
+			percent = 1
+		}
+		done := int(percent * progressBarWidth)
+		if done > progressBarWidth {
+			done = progressBarWidth
+		}
+
+		var current string
+		if len(p.Active) > 0 {
+			current = " " + path.Base(p.Active[0].Key)
+		}
+		line := fmt.Sprintf("[%s%s] %3.0f%% %d/%d files %s/%s %s/s ETA %s, %d active%s",
+			strings.Repeat("=", done), strings.Repeat(" ", progressBarWidth-done), percent*100,
+			p.DoneFiles, p.ListedFiles, byteSize(p.Bytes), byteSize(p.ListedBytes),
+			byteSize(int64(p.Throughput)), eta(p), len(p.Active), current)
+		if len(line) > 120 {
+			line = line[:120]
+		}
+		fmt.Fprintf(os.Stderr, "\r%-120s", line)
+		if p.Finished {
+			fmt.Fprintln(os.Stderr)
+		}
+	}, 500 * time.Millisecond
+}
+
+func eta(p *operators.Progress) string {
+	if p.ETA == 0 {
+		return "-"
+	}
+	if !p.ListDone {
+		return ">" + p.ETA.Truncate(time.Second).String()
+	}
+	return p.ETA.Truncate(time.Second).String()
+}
+
+func byteSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
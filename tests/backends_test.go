@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"github.com/nuclio/logger"
 	"github.com/stretchr/testify/suite"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"testing"
 	"time"
 )
@@ -32,16 +34,17 @@ func (suite *testLocalBackend) SetupSuite() {
 	client, err := backends.NewLocalClient(log, src)
 	suite.Require().Nil(err)
 
-	w, err := client.Writer(filepath.Join(tempdir, "a.txt"), nil)
+	w, err := client.Writer(context.Background(), filepath.Join(tempdir, "a.txt"), nil)
 	suite.Require().Nil(err)
 	n, err := w.Write(dummyContent)
 	suite.Require().Nil(err)
 	suite.Require().Equal(n, len(dummyContent))
+	suite.Require().Nil(w.Close())
 
 	opts := backends.FileMeta{
 		Mtime: time.Now().Add(-23 * time.Hour),
 		Mode:  777}
-	w, err = client.Writer(filepath.Join(tempdir, "a.csv"), &opts)
+	w, err = client.Writer(context.Background(), filepath.Join(tempdir, "a.csv"), &opts)
 	suite.Require().Nil(err)
 	n, err = w.Write(dummyContent)
 	suite.Require().Nil(err)
@@ -57,7 +60,7 @@ func (suite *testLocalBackend) TestRead() {
 	client, err := backends.NewLocalClient(log, src)
 	suite.Require().Nil(err)
 
-	r, err := client.Reader(filepath.Join(tempdir, "a.csv"))
+	r, err := client.Reader(context.Background(), filepath.Join(tempdir, "a.csv"))
 	data := make([]byte, 100)
 	n, err := r.Read(data)
 	suite.Require().Nil(err)
@@ -70,7 +73,7 @@ func (suite *testLocalBackend) TestList() {
 	src, err := common.UrlParse(tempdir, true)
 	listTask := backends.ListDirTask{Source: src}
 	fmt.Println(src)
-	iter, err := operators.ListDir(&listTask, log)
+	iter, err := operators.ListDir(context.Background(), &listTask, log)
 	suite.Require().Nil(err)
 
 	for iter.Next() {
@@ -84,7 +87,7 @@ func (suite *testLocalBackend) TestList() {
 
 	src, _ = common.UrlParse(tempdir+"/*.csv", true)
 	listTask = backends.ListDirTask{Source: src}
-	iter, err = operators.ListDir(&listTask, log)
+	iter, err = operators.ListDir(context.Background(), &listTask, log)
 	suite.Require().Nil(err)
 	_, err = iter.ReadAll()
 	suite.Require().Nil(err)
@@ -96,6 +99,9 @@ func (suite *testLocalBackend) TestList() {
 }
 
 func (suite *testLocalBackend) TestCopyToS3() {
+	if AWS_TEST_BUCKET == "" {
+		suite.T().Skip("AWS_TEST_BUCKET is not set")
+	}
 	src, err := common.UrlParse(tempdir, true)
 	suite.Require().Nil(err)
 
@@ -103,7 +109,7 @@ func (suite *testLocalBackend) TestCopyToS3() {
 	dst, err := common.UrlParse("s3://"+AWS_TEST_BUCKET+"/xcptests/*.*", true)
 	suite.Require().Nil(err)
 
-	err = operators.CopyDir(&listTask, dst, log, 1)
+	_, err = operators.CopyDir(context.Background(), &listTask, dst, nil, log, 1)
 	suite.Require().Nil(err)
 
 	// read list dir content from S3
@@ -113,8 +119,103 @@ func (suite *testLocalBackend) TestCopyToS3() {
 	newdst, err := common.UrlParse(dstdir, true)
 	suite.Require().Nil(err)
 
-	err = operators.CopyDir(&listTask, newdst, log, 1)
+	_, err = operators.CopyDir(context.Background(), &listTask, newdst, nil, log, 1)
+	suite.Require().Nil(err)
+}
+
+func (suite *testLocalBackend) TestAtomicWrite() {
+	src, err := common.UrlParse(tempdir, true)
 	suite.Require().Nil(err)
+	client, err := backends.NewLocalClient(log, src)
+	suite.Require().Nil(err)
+	target := filepath.Join(tempdir, "atomic", "b.txt")
+	defer os.RemoveAll(filepath.Dir(target))
+
+	// the target is only replaced on a successful Close
+	for _, content := range []string{"old content", "new content"} {
+		w, err := client.Writer(context.Background(), target, nil)
+		suite.Require().Nil(err)
+		_, err = w.Write([]byte(content))
+		suite.Require().Nil(err)
+		if content == "new content" {
+			data, err := ioutil.ReadFile(target)
+			suite.Require().Nil(err)
+			suite.Require().Equal("old content", string(data))
+		}
+		suite.Require().Nil(w.Close())
+	}
+
+	w, err := client.Writer(context.Background(), target, nil)
+	suite.Require().Nil(err)
+	_, err = w.Write([]byte("partial"))
+	suite.Require().Nil(err)
+	suite.Require().Nil(w.(backends.FSAborter).Abort())
+
+	data, err := ioutil.ReadFile(target)
+	suite.Require().Nil(err)
+	suite.Require().Equal("new content", string(data))
+	files, err := ioutil.ReadDir(filepath.Dir(target))
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, len(files))
+}
+
+func (suite *testLocalBackend) TestFileOps() {
+	src, err := common.UrlParse(tempdir, true)
+	suite.Require().Nil(err)
+	client, err := backends.NewLocalClient(log, src)
+	suite.Require().Nil(err)
+	ctx := context.Background()
+
+	f, err := client.Stat(ctx, filepath.Join(tempdir, "a.csv"))
+	suite.Require().Nil(err)
+	suite.Require().Equal(int64(len(dummyContent)), f.Size)
+	_, err = client.Stat(ctx, filepath.Join(tempdir, "missing.csv"))
+	suite.Require().True(backends.IsNotFound(err))
+
+	dir := filepath.Join(tempdir, "ops")
+	defer os.RemoveAll(dir)
+	suite.Require().Nil(client.Mkdir(ctx, filepath.Join(dir, "sub")))
+	w, err := client.Writer(ctx, filepath.Join(dir, "sub", "b.txt"), nil)
+	suite.Require().Nil(err)
+	_, err = w.Write(dummyContent)
+	suite.Require().Nil(err)
+	suite.Require().Nil(w.Close())
+
+	suite.Require().Nil(client.Rename(ctx, filepath.Join(dir, "sub", "b.txt"), filepath.Join(dir, "new", "c.txt")))
+	_, err = client.Stat(ctx, filepath.Join(dir, "sub", "b.txt"))
+	suite.Require().True(backends.IsNotFound(err))
+	suite.Require().Nil(client.Delete(ctx, filepath.Join(dir, "new", "c.txt")))
+	suite.Require().True(backends.IsNotFound(client.Delete(ctx, filepath.Join(dir, "new", "c.txt"))))
+}
+
+func (suite *testLocalBackend) TestListFilters() {
+	dir := filepath.Join(tempdir, "filters")
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"part-1.csv", "part-x.csv", "a/part-2.csv", "a/b/part-3.csv"} {
+		suite.Require().Nil(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		suite.Require().Nil(ioutil.WriteFile(filepath.Join(dir, name), dummyContent, 0644))
+	}
+	suite.Require().Nil(os.Chtimes(filepath.Join(dir, "a/part-2.csv"), old, old))
+
+	src, err := common.UrlParse(dir, true)
+	suite.Require().Nil(err)
+	list := func(task backends.ListDirTask) int {
+		task.Source, task.Recursive = src, true
+		iter, err := operators.ListDir(context.Background(), &task, log)
+		suite.Require().Nil(err)
+		_, err = iter.ReadAll()
+		suite.Require().Nil(err)
+		return iter.Summary().TotalFiles
+	}
+
+	suite.Require().Equal(4, list(backends.ListDirTask{}))
+	suite.Require().Equal(1, list(backends.ListDirTask{PathRegexp: regexp.MustCompile(`^part-\d+\.csv$`)}))
+	suite.Require().Equal(3, list(backends.ListDirTask{PathRegexp: regexp.MustCompile(`part-\d+\.csv$`)}))
+	suite.Require().Equal(2, list(backends.ListDirTask{MaxDepth: 1}))
+	suite.Require().Equal(3, list(backends.ListDirTask{MaxDepth: 2}))
+	suite.Require().Equal(2, list(backends.ListDirTask{MinDepth: 2}))
+	suite.Require().Equal(1, list(backends.ListDirTask{Until: time.Now().Add(-time.Hour)}))
 }
 
 func TestLocalBackendSuite(t *testing.T) {
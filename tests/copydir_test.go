@@ -0,0 +1,358 @@
+package tests
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+	"github.com/v3io/xcp/backends"
+	"github.com/v3io/xcp/common"
+	"github.com/v3io/xcp/operators"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCopyDir struct {
+	suite.Suite
+	srcdir string
+	dstdir string
+}
+
+func (suite *testCopyDir) SetupTest() {
+	var err error
+	suite.srcdir, err = ioutil.TempDir("", "xcptest-copy-src")
+	suite.Require().Nil(err)
+	suite.dstdir, err = ioutil.TempDir("", "xcptest-copy-dst")
+	suite.Require().Nil(err)
+
+	for _, name := range []string{"a.txt", "b.csv", "c.csv"} {
+		suite.Require().Nil(ioutil.WriteFile(filepath.Join(suite.srcdir, name), dummyContent, 0600))
+	}
+	// a directory with the same name as a source file fails the copy
+	suite.Require().Nil(os.MkdirAll(filepath.Join(suite.dstdir, "b.csv"), 0700))
+}
+
+func (suite *testCopyDir) TearDownTest() {
+	os.RemoveAll(suite.srcdir)
+	os.RemoveAll(suite.dstdir)
+}
+
+func (suite *testCopyDir) copy(opts *operators.CopyOptions) (*operators.CopyReport, error) {
+	return suite.copyWithContext(context.Background(), opts)
+}
+
+func (suite *testCopyDir) copyWithContext(ctx context.Context, opts *operators.CopyOptions) (*operators.CopyReport, error) {
+	src, err := common.UrlParse(suite.srcdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.dstdir, true)
+	suite.Require().Nil(err)
+
+	listTask := backends.ListDirTask{Source: src}
+	return operators.CopyDir(ctx, &listTask, dst, opts, log, 1)
+}
+
+func (suite *testCopyDir) TestContinueOnError() {
+	report, err := suite.copy(nil)
+	suite.Require().NotNil(err)
+	suite.Require().Equal(3, report.TotalFiles)
+	suite.Require().Equal(2, report.Copied)
+	suite.Require().Equal(1, len(report.Failed))
+	suite.Require().Equal(filepath.ToSlash(filepath.Join(suite.srcdir, "b.csv")), report.Failed[0].Key)
+}
+
+func (suite *testCopyDir) TestFailFast() {
+	report, err := suite.copy(&operators.CopyOptions{FailFast: true})
+	suite.Require().NotNil(err)
+	suite.Require().Equal(1, len(report.Failed))
+	// a.txt is listed before b.csv, c.csv is skipped after the failure
+	suite.Require().Equal(1, report.Copied)
+	_, err = os.Stat(filepath.Join(suite.dstdir, "c.csv"))
+	suite.Require().True(os.IsNotExist(err))
+}
+
+func TestCopyDirSuite(t *testing.T) {
+	log, _ = common.NewLogger("info")
+	suite.Run(t, new(testCopyDir))
+}
+
+func (suite *testCopyDir) TestCheckpoint() {
+	suite.Require().Nil(os.RemoveAll(filepath.Join(suite.dstdir, "b.csv")))
+	journal := filepath.Join(suite.dstdir, "checkpoint.json")
+
+	report, err := suite.copy(&operators.CopyOptions{Checkpoint: journal})
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, report.Copied)
+
+	report, err = suite.copy(&operators.CopyOptions{Checkpoint: journal})
+	suite.Require().Nil(err)
+	suite.Require().Equal(0, report.Copied)
+	suite.Require().Equal(3, report.Skipped)
+
+	// a changed file is copied again
+	suite.Require().Nil(ioutil.WriteFile(filepath.Join(suite.srcdir, "a.txt"), []byte("new content"), 0600))
+	report, err = suite.copy(&operators.CopyOptions{Checkpoint: journal})
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, report.Copied)
+	suite.Require().Equal(2, report.Skipped)
+}
+
+func (suite *testCopyDir) TestCheckpointUploads() {
+	journal := filepath.Join(suite.dstdir, "checkpoint.json")
+	f := &backends.FileDetails{Key: "a.bin", Size: 100, Mtime: time.Now()}
+	checkpoint, err := operators.OpenCheckpoint(journal)
+	suite.Require().Nil(err)
+	suite.Require().Nil(checkpoint.SaveUpload(f, &backends.UploadState{UploadID: "u1", PartSize: 10}))
+	for i := 1; i <= 3; i++ {
+		part := backends.UploadPart{Number: i, ETag: fmt.Sprint(i)}
+		suite.Require().Nil(checkpoint.SaveUpload(f, &backends.UploadState{UploadID: "u1", PartSize: 10, Parts: []backends.UploadPart{part}}))
+	}
+	suite.Require().Equal(3, len(checkpoint.UploadState(f).Parts))
+	suite.Require().Nil(checkpoint.Close())
+
+	// every line has a single part, the parts are added up when loading
+	data, err := ioutil.ReadFile(journal)
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, strings.Count(string(data), `"number"`))
+	checkpoint, err = operators.OpenCheckpoint(journal)
+	suite.Require().Nil(err)
+	defer checkpoint.Close()
+	suite.Require().Equal("u1", checkpoint.UploadState(f).UploadID)
+	suite.Require().Equal(3, len(checkpoint.UploadState(f).Parts))
+	suite.Require().Nil(checkpoint.StaleUpload(f))
+
+	// the upload of a changed file is stale
+	changed := &backends.FileDetails{Key: "a.bin", Size: 200, Mtime: f.Mtime}
+	suite.Require().Nil(checkpoint.UploadState(changed))
+	suite.Require().Equal("u1", checkpoint.StaleUpload(changed).UploadID)
+}
+
+func (suite *testCopyDir) TestVerify() {
+	suite.Require().Nil(os.RemoveAll(filepath.Join(suite.dstdir, "b.csv")))
+
+	report, err := suite.copy(&operators.CopyOptions{Verify: "sha256"})
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, report.Copied)
+	suite.Require().Equal(3, report.Verified)
+
+	_, err = suite.copy(&operators.CopyOptions{Verify: "sha1"})
+	suite.Require().NotNil(err)
+}
+
+func (suite *testCopyDir) TestCanceled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := suite.copyWithContext(ctx, nil)
+	suite.Require().NotNil(err)
+	suite.Require().True(report.Canceled)
+	suite.Require().Equal(0, report.Copied)
+	suite.Require().Equal(0, len(report.Failed))
+	_, err = os.Stat(filepath.Join(suite.dstdir, "a.txt"))
+	suite.Require().True(os.IsNotExist(err))
+}
+
+func (suite *testCopyDir) TestProgress() {
+	progress := make(chan *operators.Progress, 100)
+	opts := operators.CopyOptions{OnProgress: operators.ProgressToChannel(progress), ProgressInterval: time.Millisecond}
+	_, err := suite.copy(&opts)
+	suite.Require().NotNil(err)
+
+	var last *operators.Progress
+	for len(progress) > 0 {
+		last = <-progress
+	}
+	suite.Require().True(last.Finished)
+	suite.Require().True(last.ListDone)
+	suite.Require().Equal(3, last.ListedFiles)
+	suite.Require().Equal(3, last.DoneFiles)
+	suite.Require().Equal(1, last.FailedFiles)
+	suite.Require().Equal(int64(3*len(dummyContent)), last.ListedBytes)
+	suite.Require().Equal(0, len(last.Active))
+}
+
+func (suite *testCopyDir) TestReport() {
+	suite.Require().Nil(os.RemoveAll(filepath.Join(suite.dstdir, "b.csv")))
+	report, err := suite.copy(&operators.CopyOptions{Verify: "md5", Manifest: true})
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, len(report.Manifest))
+	suite.Require().False(report.EndTime.Before(report.StartTime))
+
+	reportFile := filepath.Join(suite.srcdir, "report.json")
+	suite.Require().Nil(operators.WriteReport(reportFile, report))
+	data, err := ioutil.ReadFile(reportFile)
+	suite.Require().Nil(err)
+
+	parsed := map[string]interface{}{}
+	suite.Require().Nil(json.Unmarshal(data, &parsed))
+	suite.Require().Equal(float64(3), parsed["copied"])
+	suite.Require().Equal(0, len(parsed["failed"].([]interface{})))
+	manifest := parsed["manifest"].([]interface{})
+	suite.Require().Equal(fmt.Sprintf("md5:%x", md5.Sum(dummyContent)), manifest[0].(map[string]interface{})["checksum"])
+
+	params := backends.PathParams{Kind: "s3", UserKey: "key", Secret: "secret", Token: "token"}
+	redacted := params.Redacted()
+	suite.Require().Equal("key", redacted.UserKey)
+	suite.Require().Equal("", redacted.Secret+redacted.Token)
+	suite.Require().Equal("secret", params.Secret)
+}
+
+func (suite *testCopyDir) TestMove() {
+	subdir := filepath.Join(suite.srcdir, "sub", "deep")
+	suite.Require().Nil(os.MkdirAll(subdir, 0700))
+	suite.Require().Nil(ioutil.WriteFile(filepath.Join(subdir, "d.txt"), dummyContent, 0600))
+	src, err := common.UrlParse(suite.srcdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.dstdir, true)
+	suite.Require().Nil(err)
+
+	listTask := backends.ListDirTask{Source: src, Recursive: true}
+	opts := operators.CopyOptions{Move: true, PruneEmptyDirs: true}
+	report, err := operators.CopyDir(context.Background(), &listTask, dst, &opts, log, 1)
+	suite.Require().NotNil(err)
+	suite.Require().Equal(3, report.Deleted)
+	suite.Require().Equal(2, report.PrunedDirs)
+
+	// only the failed file is kept in the source
+	files, err := ioutil.ReadDir(suite.srcdir)
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, len(files))
+	suite.Require().Equal("b.csv", files[0].Name())
+	_, err = os.Stat(filepath.Join(suite.dstdir, "sub", "deep", "d.txt"))
+	suite.Require().Nil(err)
+}
+
+func (suite *testCopyDir) TestOnConflict() {
+	existing := filepath.Join(suite.dstdir, "a.txt")
+	suite.Require().Nil(ioutil.WriteFile(existing, []byte("curated"), 0600))
+
+	// b.csv exists as a directory in the destination
+	report, err := suite.copy(&operators.CopyOptions{OnConflict: operators.ConflictSkip})
+	suite.Require().Nil(err)
+	suite.Require().Equal(2, report.SkippedExisting)
+	suite.Require().Equal(1, report.Copied)
+	data, err := ioutil.ReadFile(existing)
+	suite.Require().Nil(err)
+	suite.Require().Equal("curated", string(data))
+
+	report, err = suite.copy(&operators.CopyOptions{OnConflict: operators.ConflictSkipIfSameSize})
+	suite.Require().NotNil(err)
+	suite.Require().Equal(1, report.SkippedExisting)
+	suite.Require().Equal(1, report.Overwritten)
+
+	suite.Require().Nil(ioutil.WriteFile(existing, []byte("curated"), 0600))
+	report, err = suite.copy(&operators.CopyOptions{OnConflict: operators.ConflictRename})
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, report.Renamed)
+	data, err = ioutil.ReadFile(filepath.Join(suite.dstdir, "a.1.txt"))
+	suite.Require().Nil(err)
+	suite.Require().Equal(dummyContent, data)
+
+	report, err = suite.copy(&operators.CopyOptions{OnConflict: operators.ConflictFail})
+	suite.Require().NotNil(err)
+	suite.Require().Equal(3, len(report.Failed))
+	suite.Require().Equal(operators.ErrDestinationExists, errors.Cause(report.Failed[0].Err))
+
+	_, err = suite.copy(&operators.CopyOptions{OnConflict: "keep"})
+	suite.Require().NotNil(err)
+}
+
+func (suite *testCopyDir) TestDryRun() {
+	report, err := suite.copy(&operators.CopyOptions{DryRun: true, Move: true, OnConflict: operators.ConflictSkip})
+	suite.Require().Nil(err)
+	suite.Require().Equal(2, report.Copied)
+	suite.Require().Equal(1, report.SkippedExisting)
+	suite.Require().Equal(2, report.Deleted)
+
+	actions := map[string]int{}
+	for _, a := range report.Actions {
+		actions[a.Action]++
+	}
+	suite.Require().Equal(map[string]int{operators.ActionCopy: 2, operators.ActionSkip: 1, operators.ActionDelete: 2}, actions)
+
+	// nothing was written or deleted
+	files, err := ioutil.ReadDir(suite.srcdir)
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, len(files))
+	files, err = ioutil.ReadDir(suite.dstdir)
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, len(files))
+}
+
+func (suite *testCopyDir) TestDryRunOverwrite() {
+	// the default policy overwrites without checking, a dry run still reports it
+	suite.Require().Nil(ioutil.WriteFile(filepath.Join(suite.dstdir, "a.txt"), dummyContent, 0600))
+	report, err := suite.copy(&operators.CopyOptions{DryRun: true})
+	suite.Require().Nil(err)
+	suite.Require().Equal(3, report.Copied)
+	suite.Require().Equal(2, report.Overwritten)
+
+	actions := map[string]int{}
+	for _, a := range report.Actions {
+		actions[a.Action]++
+	}
+	suite.Require().Equal(map[string]int{operators.ActionCopy: 1, operators.ActionOverwrite: 2}, actions)
+}
+
+func (suite *testCopyDir) TestCopySingleFile() {
+	// the source is a file, copied to a file with another name
+	src, err := common.UrlParse(filepath.Join(suite.srcdir, "a.txt"), true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(filepath.Join(suite.dstdir, "copy.txt"), true)
+	suite.Require().Nil(err)
+	listTask := backends.ListDirTask{Source: src, MaxDepth: 1}
+	report, err := operators.CopyDir(context.Background(), &listTask, dst, nil, log, 1)
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, report.Copied)
+
+	data, err := ioutil.ReadFile(filepath.Join(suite.dstdir, "copy.txt"))
+	suite.Require().Nil(err)
+	suite.Require().Equal(dummyContent, data)
+}
+
+func (suite *testCopyDir) TestFilesFrom() {
+	list := filepath.Join(suite.dstdir, "list.txt")
+	content := "a.txt\n\n{\"key\": \"c.csv\", \"size\": 13}\nmissing.csv\n"
+	suite.Require().Nil(ioutil.WriteFile(list, []byte(content), 0600))
+
+	report, err := suite.copy(&operators.CopyOptions{FilesFrom: list})
+	suite.Require().NotNil(err)
+	suite.Require().Equal(2, report.TotalFiles)
+	suite.Require().Equal(2, report.Copied)
+	suite.Require().Equal(1, len(report.Failed))
+	suite.Require().True(backends.IsNotFound(report.Failed[0].Err))
+	suite.Require().Equal(filepath.ToSlash(filepath.Join(suite.srcdir, "missing.csv")), report.Failed[0].Key)
+
+	for _, name := range []string{"a.txt", "c.csv"} {
+		data, err := ioutil.ReadFile(filepath.Join(suite.dstdir, name))
+		suite.Require().Nil(err)
+		suite.Require().Equal(dummyContent, data)
+	}
+}
+
+func (suite *testCopyDir) TestFilesFromWithoutMtime() {
+	list := filepath.Join(suite.dstdir, "list.txt")
+	suite.Require().Nil(ioutil.WriteFile(list, []byte("{\"key\": \"c.csv\", \"size\": 13}\n"), 0600))
+	src, err := common.UrlParse(suite.srcdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.dstdir, true)
+	suite.Require().Nil(err)
+
+	// the entry has no mtime, the file is checked with stat for the time filter
+	// and the preserved mtime
+	listTask := backends.ListDirTask{Source: src, Since: time.Now().Add(-time.Hour), WithMeta: true}
+	report, err := operators.CopyDir(context.Background(), &listTask, dst, &operators.CopyOptions{FilesFrom: list}, log, 1)
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, report.Copied)
+
+	srcStat, err := os.Stat(filepath.Join(suite.srcdir, "c.csv"))
+	suite.Require().Nil(err)
+	dstStat, err := os.Stat(filepath.Join(suite.dstdir, "c.csv"))
+	suite.Require().Nil(err)
+	suite.Require().True(srcStat.ModTime().Truncate(time.Second).Equal(dstStat.ModTime().Truncate(time.Second)))
+}
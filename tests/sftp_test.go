@@ -0,0 +1,319 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/suite"
+	"github.com/v3io/xcp/backends"
+	"github.com/v3io/xcp/common"
+	"github.com/v3io/xcp/operators"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const sftpTestUser = "xcp"
+const sftpTestPassword = "secret"
+
+// the number of open ssh connections to the test server
+var sftpConnections int32
+
+type testSftpBackend struct {
+	suite.Suite
+	listener net.Listener
+	key      *rsa.PrivateKey
+	rootdir  string
+}
+
+func (suite *testSftpBackend) SetupSuite() {
+	var err error
+	suite.rootdir, err = ioutil.TempDir("", "xcptest-sftp")
+	suite.Require().Nil(err)
+	suite.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().Nil(err)
+	signer, err := ssh.NewSignerFromKey(suite.key)
+	suite.Require().Nil(err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == sftpTestUser && string(pass) == sftpTestPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(signer.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	suite.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	go serveSftp(suite.listener, config)
+
+	knownHosts := filepath.Join(suite.rootdir, "known_hosts")
+	line := knownhosts.Line([]string{suite.listener.Addr().String()}, signer.PublicKey())
+	suite.Require().Nil(ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+	os.Setenv(backends.SSHKnownHostsEnvironmentVariable, knownHosts)
+	os.Unsetenv(backends.SSHInsecureEnvironmentVariable)
+	os.Unsetenv(backends.SSHKeyFileEnvironmentVariable)
+	os.Unsetenv(backends.SSHAgentEnvironmentVariable)
+}
+
+func (suite *testSftpBackend) TearDownSuite() {
+	suite.listener.Close()
+	os.RemoveAll(suite.rootdir)
+}
+
+// serveSftp is a minimal in-process ssh server which serves the sftp subsystem
+func serveSftp(listener net.Listener, config *ssh.ServerConfig) {
+	for {
+		nConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&sftpConnections, 1)
+			go func() {
+				conn.Wait()
+				atomic.AddInt32(&sftpConnections, -1)
+			}()
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+
+				go func(in <-chan *ssh.Request) {
+					for req := range in {
+						req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+					}
+				}(requests)
+
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				// end the session when the client closes its side
+				go func() {
+					server.Serve()
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func (suite *testSftpBackend) url(path string) string {
+	return fmt.Sprintf("sftp://%s:%s@%s%s", sftpTestUser, sftpTestPassword, suite.listener.Addr(), path)
+}
+
+func (suite *testSftpBackend) TestWriteReadList() {
+	src, err := common.UrlParse(suite.url(suite.rootdir+"/rw"), true)
+	suite.Require().Nil(err)
+	client, err := backends.GetNewClient(log, src)
+	suite.Require().Nil(err)
+	defer backends.CloseClient(client)
+
+	mtime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	w, err := client.Writer(context.Background(), suite.rootdir+"/rw/sub/a.csv", &backends.FileMeta{Mtime: mtime, Mode: 0640})
+	suite.Require().Nil(err)
+	_, err = w.Write(dummyContent)
+	suite.Require().Nil(err)
+	suite.Require().Nil(w.Close())
+
+	r, err := client.Reader(context.Background(), suite.rootdir+"/rw/sub/a.csv")
+	suite.Require().Nil(err)
+	data, err := ioutil.ReadAll(r)
+	suite.Require().Nil(err)
+	suite.Require().Equal(dummyContent, data)
+	meta, err := r.Stat()
+	suite.Require().Nil(err)
+	suite.Require().Equal(uint32(0640), meta.Mode)
+	suite.Require().True(mtime.Equal(meta.Mtime))
+	suite.Require().Nil(r.Close())
+
+	listTask := backends.ListDirTask{Source: src}
+	iter, err := operators.ListDir(context.Background(), &listTask, log)
+	suite.Require().Nil(err)
+	files, err := iter.ReadAll()
+	suite.Require().Nil(err)
+	suite.Require().Equal(0, len(files))
+
+	listTask = backends.ListDirTask{Source: src, Recursive: true}
+	iter, err = operators.ListDir(context.Background(), &listTask, log)
+	suite.Require().Nil(err)
+	files, err = iter.ReadAll()
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, len(files))
+	suite.Require().Equal(int64(len(dummyContent)), files[0].Size)
+	suite.Require().True(mtime.Equal(files[0].Mtime))
+}
+
+func (suite *testSftpBackend) TestCopyRoundTrip() {
+	localdir, err := ioutil.TempDir("", "xcptest-sftp-src")
+	suite.Require().Nil(err)
+	defer os.RemoveAll(localdir)
+	for _, name := range []string{"a.txt", "b.csv", "sub/c.csv"} {
+		suite.Require().Nil(os.MkdirAll(filepath.Dir(filepath.Join(localdir, name)), 0700))
+		suite.Require().Nil(ioutil.WriteFile(filepath.Join(localdir, name), dummyContent, 0600))
+	}
+
+	src, err := common.UrlParse(localdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.url(suite.rootdir+"/copy"), true)
+	suite.Require().Nil(err)
+	listTask := backends.ListDirTask{Source: src, Recursive: true, WithMeta: true}
+	_, err = operators.CopyDir(context.Background(), &listTask, dst, nil, log, 2)
+	suite.Require().Nil(err)
+
+	src, err = common.UrlParse(suite.url(suite.rootdir+"/copy/*.csv"), true)
+	suite.Require().Nil(err)
+	backdir, err := ioutil.TempDir("", "xcptest-sftp-dst")
+	suite.Require().Nil(err)
+	defer os.RemoveAll(backdir)
+	dst, err = common.UrlParse(backdir, true)
+	suite.Require().Nil(err)
+	listTask = backends.ListDirTask{Source: src, Recursive: true, WithMeta: true}
+	_, err = operators.CopyDir(context.Background(), &listTask, dst, nil, log, 2)
+	suite.Require().Nil(err)
+
+	for _, name := range []string{"b.csv", "sub/c.csv"} {
+		stat, err := os.Stat(filepath.Join(backdir, name))
+		suite.Require().Nil(err)
+		suite.Require().Equal(os.FileMode(0600), stat.Mode().Perm())
+	}
+	_, err = os.Stat(filepath.Join(backdir, "a.txt"))
+	suite.Require().True(os.IsNotExist(err))
+}
+
+func (suite *testSftpBackend) TestCloseConnections() {
+	localdir, err := ioutil.TempDir("", "xcptest-sftp-src")
+	suite.Require().Nil(err)
+	defer os.RemoveAll(localdir)
+	suite.Require().Nil(ioutil.WriteFile(filepath.Join(localdir, "a.txt"), dummyContent, 0600))
+
+	open := atomic.LoadInt32(&sftpConnections)
+	src, err := common.UrlParse(localdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.url(suite.rootdir+"/close"), true)
+	suite.Require().Nil(err)
+	listTask := backends.ListDirTask{Source: src}
+	_, err = operators.CopyDir(context.Background(), &listTask, dst, nil, log, 2)
+	suite.Require().Nil(err)
+	_, err = operators.SyncDir(context.Background(), &listTask, dst, &operators.SyncOptions{Delete: true}, log, 2)
+	suite.Require().Nil(err)
+
+	// the server sees the connections end asynchronously
+	for i := 0; i < 100 && atomic.LoadInt32(&sftpConnections) > open; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	suite.Require().Equal(open, atomic.LoadInt32(&sftpConnections))
+}
+
+func (suite *testSftpBackend) TestKeyFileAuth() {
+	keyFile := filepath.Join(suite.rootdir, "id_rsa")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(suite.key)})
+	suite.Require().Nil(ioutil.WriteFile(keyFile, keyPem, 0600))
+	os.Setenv(backends.SSHKeyFileEnvironmentVariable, keyFile)
+	defer os.Unsetenv(backends.SSHKeyFileEnvironmentVariable)
+
+	params, err := common.UrlParse(fmt.Sprintf("scp://%s@%s%s/", sftpTestUser, suite.listener.Addr(), suite.rootdir), true)
+	suite.Require().Nil(err)
+	client, err := backends.GetNewClient(log, params)
+	suite.Require().Nil(err)
+	suite.Require().Nil(backends.CloseClient(client))
+}
+
+func (suite *testSftpBackend) TestAgentAuth() {
+	keyring := agent.NewKeyring()
+	suite.Require().Nil(keyring.Add(agent.AddedKey{PrivateKey: suite.key}))
+	socket := filepath.Join(suite.rootdir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	suite.Require().Nil(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	os.Setenv(backends.SSHAgentEnvironmentVariable, socket)
+	defer os.Unsetenv(backends.SSHAgentEnvironmentVariable)
+
+	params, err := common.UrlParse(fmt.Sprintf("sftp://%s@%s%s/", sftpTestUser, suite.listener.Addr(), suite.rootdir), true)
+	suite.Require().Nil(err)
+	client, err := backends.GetNewClient(log, params)
+	suite.Require().Nil(err)
+	suite.Require().Nil(backends.CloseClient(client))
+}
+
+func (suite *testSftpBackend) TestBadPassword() {
+	params, err := common.UrlParse(fmt.Sprintf("sftp://%s:wrong@%s%s/", sftpTestUser, suite.listener.Addr(), suite.rootdir), true)
+	suite.Require().Nil(err)
+	_, err = backends.GetNewClient(log, params)
+	suite.Require().NotNil(err)
+}
+
+func (suite *testSftpBackend) TestHostKeyVerification() {
+	params, err := common.UrlParse(suite.url(suite.rootdir+"/"), true)
+	suite.Require().Nil(err)
+	knownHosts := os.Getenv(backends.SSHKnownHostsEnvironmentVariable)
+	defer os.Setenv(backends.SSHKnownHostsEnvironmentVariable, knownHosts)
+
+	// an unknown host key fails
+	other := filepath.Join(suite.rootdir, "other_known_hosts")
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	suite.Require().Nil(err)
+	otherKey, err := ssh.NewPublicKey(&key.PublicKey)
+	suite.Require().Nil(err)
+	line := knownhosts.Line([]string{suite.listener.Addr().String()}, otherKey)
+	suite.Require().Nil(ioutil.WriteFile(other, []byte(line+"\n"), 0600))
+	os.Setenv(backends.SSHKnownHostsEnvironmentVariable, other)
+	_, err = backends.GetNewClient(log, params)
+	suite.Require().NotNil(err)
+
+	// a missing known hosts file fails unless the verification is disabled
+	os.Setenv(backends.SSHKnownHostsEnvironmentVariable, filepath.Join(suite.rootdir, "no_known_hosts"))
+	_, err = backends.GetNewClient(log, params)
+	suite.Require().NotNil(err)
+	os.Setenv(backends.SSHInsecureEnvironmentVariable, "1")
+	defer os.Unsetenv(backends.SSHInsecureEnvironmentVariable)
+	client, err := backends.GetNewClient(log, params)
+	suite.Require().Nil(err)
+	suite.Require().Nil(backends.CloseClient(client))
+}
+
+func TestSftpBackendSuite(t *testing.T) {
+	log, _ = common.NewLogger("info")
+	suite.Run(t, new(testSftpBackend))
+}
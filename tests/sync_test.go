@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	"github.com/v3io/xcp/backends"
+	"github.com/v3io/xcp/common"
+	"github.com/v3io/xcp/operators"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testSyncDir struct {
+	suite.Suite
+	srcdir string
+	dstdir string
+}
+
+func (suite *testSyncDir) SetupTest() {
+	var err error
+	suite.srcdir, err = ioutil.TempDir("", "xcptest-sync-src")
+	suite.Require().Nil(err)
+	suite.dstdir, err = ioutil.TempDir("", "xcptest-sync-dst")
+	suite.Require().Nil(err)
+
+	for _, name := range []string{"a.txt", "b.csv", "sub/c.csv"} {
+		suite.writeFile(suite.srcdir, name, dummyContent)
+	}
+}
+
+func (suite *testSyncDir) TearDownTest() {
+	os.RemoveAll(suite.srcdir)
+	os.RemoveAll(suite.dstdir)
+}
+
+func (suite *testSyncDir) writeFile(dir, name string, data []byte) {
+	fullpath := filepath.Join(dir, name)
+	suite.Require().Nil(os.MkdirAll(filepath.Dir(fullpath), 0700))
+	suite.Require().Nil(ioutil.WriteFile(fullpath, data, 0600))
+}
+
+func (suite *testSyncDir) sync(opts *operators.SyncOptions) *operators.SyncReport {
+	src, err := common.UrlParse(suite.srcdir, true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.dstdir, true)
+	suite.Require().Nil(err)
+
+	listTask := backends.ListDirTask{Source: src, Recursive: true, WithMeta: true}
+	report, err := operators.SyncDir(context.Background(), &listTask, dst, opts, log, 2)
+	suite.Require().Nil(err)
+	return report
+}
+
+func (suite *testSyncDir) TestSyncSingleFile() {
+	src, err := common.UrlParse(filepath.Join(suite.srcdir, "a.txt"), true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(filepath.Join(suite.dstdir, "copy.txt"), true)
+	suite.Require().Nil(err)
+	listTask := backends.ListDirTask{Source: src}
+	report, err := operators.SyncDir(context.Background(), &listTask, dst, &operators.SyncOptions{}, log, 1)
+	suite.Require().Nil(err)
+	suite.Require().Equal(1, len(report.Copied))
+
+	report, err = operators.SyncDir(context.Background(), &listTask, dst, &operators.SyncOptions{}, log, 1)
+	suite.Require().Nil(err)
+	suite.Require().Equal(0, len(report.Copied))
+	suite.Require().Equal(1, report.Unchanged)
+}
+
+func (suite *testSyncDir) TestSyncChanged() {
+	// nil options are the defaults
+	report := suite.sync(nil)
+	suite.Require().Equal(3, len(report.Copied))
+
+	report = suite.sync(&operators.SyncOptions{})
+	suite.Require().Equal(0, len(report.Copied))
+	suite.Require().Equal(3, report.Unchanged)
+
+	// changed size, newer mtime and a new file
+	suite.writeFile(suite.srcdir, "a.txt", []byte("new content"))
+	later := time.Now().Add(time.Hour)
+	suite.Require().Nil(os.Chtimes(filepath.Join(suite.srcdir, "b.csv"), later, later))
+	suite.writeFile(suite.srcdir, "sub/d.csv", dummyContent)
+	report = suite.sync(&operators.SyncOptions{})
+	suite.Require().Equal(3, len(report.Copied))
+	suite.Require().Equal(1, report.Unchanged)
+
+	data, err := ioutil.ReadFile(filepath.Join(suite.dstdir, "a.txt"))
+	suite.Require().Nil(err)
+	suite.Require().Equal([]byte("new content"), data)
+}
+
+func (suite *testSyncDir) TestSyncChecksum() {
+	suite.sync(&operators.SyncOptions{})
+
+	// same size and older mtime, only detected by the checksum
+	suite.writeFile(suite.dstdir, "b.csv", []byte("dummy CONTENT"))
+	later := time.Now().Add(time.Hour)
+	suite.Require().Nil(os.Chtimes(filepath.Join(suite.dstdir, "b.csv"), later, later))
+	report := suite.sync(&operators.SyncOptions{})
+	suite.Require().Equal(0, len(report.Copied))
+
+	report = suite.sync(&operators.SyncOptions{Checksum: true})
+	suite.Require().Equal(1, len(report.Copied))
+	suite.Require().Equal(2, report.Unchanged)
+}
+
+func (suite *testSyncDir) TestSyncDeleteDryRun() {
+	suite.sync(&operators.SyncOptions{})
+	suite.writeFile(suite.dstdir, "extra.csv", dummyContent)
+	suite.writeFile(suite.srcdir, "new.csv", dummyContent)
+
+	report := suite.sync(&operators.SyncOptions{CopyOptions: operators.CopyOptions{DryRun: true}, Delete: true})
+	suite.Require().Equal(1, len(report.Copied))
+	suite.Require().Equal(1, len(report.Deleted))
+	_, err := os.Stat(filepath.Join(suite.dstdir, "extra.csv"))
+	suite.Require().Nil(err)
+	_, err = os.Stat(filepath.Join(suite.dstdir, "new.csv"))
+	suite.Require().True(os.IsNotExist(err))
+
+	report = suite.sync(&operators.SyncOptions{Delete: true})
+	suite.Require().Equal(1, len(report.Deleted))
+	_, err = os.Stat(filepath.Join(suite.dstdir, "extra.csv"))
+	suite.Require().True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(suite.dstdir, "new.csv"))
+	suite.Require().Nil(err)
+}
+
+func TestSyncDirSuite(t *testing.T) {
+	log, _ = common.NewLogger("info")
+	suite.Run(t, new(testSyncDir))
+}
+
+func (suite *testSyncDir) TestSyncPathPattern() {
+	suite.writeFile(suite.srcdir, "sub/d.txt", dummyContent)
+	src, err := common.UrlParse(suite.srcdir+"/*/*.csv", true)
+	suite.Require().Nil(err)
+	dst, err := common.UrlParse(suite.dstdir, true)
+	suite.Require().Nil(err)
+	sync := func() *operators.SyncReport {
+		listTask := backends.ListDirTask{Source: src}
+		report, err := operators.SyncDir(context.Background(), &listTask, dst, &operators.SyncOptions{Delete: true}, log, 2)
+		suite.Require().Nil(err)
+		return report
+	}
+
+	suite.Require().Equal(1, len(sync().Copied))
+	// the target files below the listed dir are compared and deleted
+	suite.writeFile(suite.dstdir, "sub/extra.csv", dummyContent)
+	report := sync()
+	suite.Require().Equal(0, len(report.Copied))
+	suite.Require().Equal(1, report.Unchanged)
+	suite.Require().Equal(1, len(report.Deleted))
+}
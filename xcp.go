@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/v3io/xcp/backends"
 	"github.com/v3io/xcp/common"
 	"github.com/v3io/xcp/operators"
 	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -18,13 +24,45 @@ func main() {
 	minSize := flag.Int("n", 0, "minimum file size")
 	workers := flag.Int("w", 8, "num of worker routines")
 	logLevel := flag.String("v", "info", "log level: info | debug")
+	filter := backends.NewFilter()
+	flag.Var(&filterFlag{filter.Include}, "include", "include the paths matching a pattern, e.g. 'data/**/*.csv' (repeatable)")
+	flag.Var(&filterFlag{filter.Exclude}, "exclude", "exclude the paths matching a pattern, e.g. '*.tmp' or 'logs/' (repeatable)")
+	flag.Var(&filterFlag{filter.ExcludeFrom}, "exclude-from", "read exclude patterns from a file (gitignore style)")
 	mtime := flag.String("t", "", "minimal file time e.g. 'now-7d' or RFC3339 date")
+	until := flag.String("until", "", "maximal file time e.g. 'now-1d' or RFC3339 date")
+	pathRegexp := flag.String("regex", "", "regular expression of the path relative to the source dir, e.g. '^part-\\d+\\.csv$'")
+	minDepth := flag.Int("mindepth", 0, "minimal depth of the files, the files in the source dir are at depth 1")
+	maxDepth := flag.Int("maxdepth", 0, "maximal depth of the files (with -r), the files in the source dir are at depth 1")
+	preserve := flag.Bool("preserve", false, "preserve the files mtime and mode (stored as object metadata on s3 and v3io)")
+	syncMode := flag.Bool("sync", false, "sync mode, copy only new or changed files")
+	deleteExtra := flag.Bool("delete", false, "with -sync, delete destination files which are not in the source")
+	checksum := flag.Bool("checksum", false, "with -sync, compare files by checksum instead of size and mtime")
+	dryRun := flag.Bool("dry-run", false, "only print the planned actions (copy, skip, overwrite, rename, delete), do not write or delete")
+	retries := flag.Int("retries", 3, "max attempts per file/request on transient errors (1 disables retries)")
+	retryBackoff := flag.Duration("retry-backoff", time.Second, "initial delay between retries, doubled on every retry")
+	checkpoint := flag.String("checkpoint", "", "journal file of completed files, re-run with the same file to resume a copy")
+	verify := flag.String("verify", "", "verify the copied files checksum: md5 | crc32c | sha256 (large s3 files are read back, see README)")
+	inPlace := flag.Bool("in-place", false, "write local files in place instead of a temp file renamed when complete")
+	showProgress := flag.Bool("progress", true, "show the progress, a progress bar on a terminal or periodic log lines")
+	reportFile := flag.String("report", "", "write a json report of the copy/sync to this file")
+	manifest := flag.Bool("manifest", false, "with -report, list every copied file (size, mtime and checksum)")
+	onConflict := flag.String("on-conflict", "overwrite",
+		"policy for existing destination files: overwrite | skip | skip-if-same-size | overwrite-if-newer | rename | fail")
+	move := flag.Bool("move", false, "delete every source file after it is copied (and verified)")
+	pruneEmpty := flag.Bool("prune-empty", false, "with -move, remove the source directories left empty")
+	filesFrom := flag.String("files-from", "", "copy the files in this list (paths relative to the source, or json lines with key and size), - for stdin")
+	failFast := flag.Bool("fail-fast", false, "stop on the first failed file (by default continue with the other files)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: xcp [flags] source dest\n\nsupported URL schemes: %s\n\nflags:\n",
+			strings.Join(backends.Schemes(), ", "))
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	logger, _ := common.NewLogger(*logLevel)
 	args := flag.Args()
 	if len(args) != 2 {
-		fmt.Println("Error missing source or destination: usage xcp [flags] source dest\n")
+		fmt.Println("Error missing source or destination: usage xcp [flags] source dest")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -41,18 +79,150 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	untilTime, err := common.String2Time(*until)
+	if err != nil {
+		panic(err)
+	}
+
+	backends.Retry.MaxAttempts = *retries
+	backends.Retry.Backoff = *retryBackoff
+	backends.LocalInPlaceWrites = *inPlace
 
 	listTask := backends.ListDirTask{
 		Source:    src,
 		Since:     since,
+		Until:     untilTime,
+		MinDepth:  *minDepth,
+		MaxDepth:  *maxDepth,
 		Recursive: *recursive,
 		MaxSize:   int64(*maxSize),
 		MinSize:   int64(*minSize),
 		Hidden:    *hidden,
 		InclEmpty: *copyEmpty,
+		WithMeta:  *preserve,
+		Filter:    filter,
+	}
+	if *pathRegexp != "" {
+		if listTask.PathRegexp, err = regexp.Compile(*pathRegexp); err != nil {
+			fmt.Println("Error: bad -regex,", err)
+			os.Exit(1)
+		}
 	}
 
-	if err := operators.CopyDir(&listTask, dst, logger, *workers); err != nil {
-		panic(err)
+	ctx := interruptContext()
+	copyOpts := operators.CopyOptions{FailFast: *failFast, Checkpoint: *checkpoint, Verify: *verify, Manifest: *manifest,
+		Move: *move, PruneEmptyDirs: *pruneEmpty, OnConflict: *onConflict, DryRun: *dryRun, FilesFrom: *filesFrom}
+	if *showProgress {
+		copyOpts.OnProgress, copyOpts.ProgressInterval = progressPrinter(logger)
+	}
+	if *syncMode {
+		if *move || *onConflict != operators.ConflictOverwrite || *filesFrom != "" || *checkpoint != "" || *manifest {
+			fmt.Println("Error: -move, -on-conflict, -files-from, -checkpoint and -manifest are not supported with -sync")
+			os.Exit(1)
+		}
+		opts := operators.SyncOptions{CopyOptions: copyOpts, Checksum: *checksum, Delete: *deleteExtra}
+		report, err := operators.SyncDir(ctx, &listTask, dst, &opts, logger, *workers)
+		if report != nil {
+			if *dryRun {
+				printPlan(report.Actions)
+				fmt.Printf("dry run: %d files to copy, %d files to delete, %d files unchanged\n",
+					len(report.Copied), len(report.Deleted), report.Unchanged)
+			}
+			printFailed(report.Failed)
+			if report.Canceled {
+				fmt.Printf("interrupted: copied %d files, deleted %d files, %d files unchanged\n",
+					len(report.Copied), len(report.Deleted), report.Unchanged)
+			}
+			writeReport(*reportFile, report)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	report, err := operators.CopyDir(ctx, &listTask, dst, &copyOpts, logger, *workers)
+	if report != nil {
+		if *dryRun {
+			printPlan(report.Actions)
+			fmt.Printf("dry run: %d files to copy (%d KB), %d overwritten, %d renamed, %d skipped, %d source files to delete\n",
+				report.Copied, report.CopiedBytes/1024, report.Overwritten, report.Renamed,
+				report.Skipped+report.SkippedExisting, report.Deleted)
+		}
+		printFailed(report.Failed)
+		if report.Canceled {
+			fmt.Printf("interrupted: copied %d of %d listed files (%d KB), skipped %d files, failed %d files\n",
+				report.Copied, report.TotalFiles, report.CopiedBytes/1024, report.Skipped, len(report.Failed))
+		}
+		if *onConflict != operators.ConflictOverwrite {
+			fmt.Printf("existing files: skipped %d, overwritten %d, renamed %d\n",
+				report.SkippedExisting, report.Overwritten, report.Renamed)
+		}
+		if *move {
+			fmt.Printf("moved: deleted %d source files, removed %d empty dirs\n", report.Deleted, report.PrunedDirs)
+		}
+		writeReport(*reportFile, report)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// interruptContext returns a context which is canceled on the first SIGINT or
+// SIGTERM (stop listing and roll back the files in progress), a second signal
+// exits immediately
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("\nreceived %v, stopping and rolling back the files in progress (repeat to exit now)\n", sig)
+		cancel()
+		<-signals
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+func writeReport(path string, report interface{}) {
+	if path == "" {
+		return
+	}
+	if err := operators.WriteReport(path, report); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func printFailed(failed []*operators.FileError) {
+	for _, f := range failed {
+		fmt.Printf("failed %s: %v\n", f.Key, f.Err)
+	}
+}
+
+func printPlan(actions []*operators.FileAction) {
+	for _, a := range actions {
+		if a.Target != "" {
+			fmt.Printf("%-9s %s -> %s (%d bytes)\n", a.Action, a.Key, a.Target, a.Size)
+		} else {
+			fmt.Printf("%-9s %s\n", a.Action, a.Key)
+		}
 	}
 }
+
+// filterFlag adds the value of a repeatable flag to the filter, in the order
+// of the command line
+type filterFlag struct {
+	add func(string) error
+}
+
+func (f *filterFlag) String() string {
+	return ""
+}
+
+func (f *filterFlag) Set(value string) error {
+	return f.add(value)
+}